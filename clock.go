@@ -0,0 +1,259 @@
+package labrpc
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock 是 Network 计算延迟、超时使用的时钟
+// 默认使用真实时间; 测试中可以换成 SimClock 让延迟瞬间完成
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// 可以取消的定时器, 等待可能提前结束时应该使用它代替 After
+// 与 SimClock 一起使用时, 没有 Stop() 的定时器会让时间推进到它的到期时刻
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool // 定时器已经到期或者已经停止时返回 false
+}
+
+// 真实时间
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+// 使用指定的时钟
+func WithClock(c Clock) Option {
+	return func(rn *Network) {
+		rn.clock = c
+	}
+}
+
+// 返回 Network 使用的时钟, 服务端也应该用它来计时, 保证与网络的延迟一致
+func (rn *Network) Clock() Clock {
+	return rn.clock
+}
+
+// 返回 servername 使用的时钟, Now() 加上了 SetClockSkew 设置的偏移
+// 偏移是动态读取的, 之后的 SetClockSkew 对已经返回的时钟同样生效
+func (rn *Network) ServerClock(servername interface{}) Clock {
+	return &skewedClock{rn: rn, servername: servername}
+}
+
+// 设置 servername 的时钟偏移, 用于模拟各个 server 的时钟不一致
+func (rn *Network) SetClockSkew(servername interface{}, skew time.Duration) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if skew == 0 {
+		delete(rn.skews, servername)
+	} else {
+		rn.skews[servername] = skew
+	}
+}
+
+// servername 的时钟偏移
+func (rn *Network) ClockSkew(servername interface{}) time.Duration {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.skews[servername]
+}
+
+// 带偏移的时钟, 只影响 Now(); Sleep/After 的时长不变
+type skewedClock struct {
+	rn         *Network
+	servername interface{}
+}
+
+func (c *skewedClock) Now() time.Time {
+	return c.rn.clock.Now().Add(c.rn.ClockSkew(c.servername))
+}
+
+func (c *skewedClock) Sleep(d time.Duration) {
+	c.rn.clock.Sleep(d)
+}
+
+func (c *skewedClock) After(d time.Duration) <-chan time.Time {
+	return c.rn.clock.After(d)
+}
+
+func (c *skewedClock) NewTimer(d time.Duration) Timer {
+	return c.rn.clock.NewTimer(d)
+}
+
+// SimClock 模拟时钟
+// 当所有 goroutine 都阻塞时(一段时间内没有 goroutine 使用该时钟), 时间直接跳到最早的到期时刻,
+// 因此 Sleep/After 不需要真的等待. 是否阻塞是通过观察时钟的使用推断出来的:
+// 不使用时钟而长时间计算的 goroutine 会被认为已经阻塞
+type SimClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*simWaiter // 按 deadline 排序
+	epoch   uint64       // 每次使用时钟都会递增, 用于判断是否有 goroutine 在运行
+	wake    chan struct{}
+	stop    chan struct{}
+}
+
+type simWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// 模拟时钟的空闲判断: 让出 CPU 若干次并短暂休眠后, 时钟没有被使用则认为所有 goroutine 都已阻塞
+const (
+	simYields = 20
+	simSettle = 50 * time.Microsecond
+)
+
+// 创建一个自动推进的模拟时钟, 不再使用时调用 Stop()
+func NewSimClock(start time.Time) *SimClock {
+	c := &SimClock{
+		now:  start,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	return c.now
+}
+
+func (c *SimClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *SimClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *SimClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	w := &simWaiter{deadline: c.now.Add(d), ch: make(chan time.Time, 1)}
+	t := &simTimer{c: c, w: w}
+	if d <= 0 {
+		w.ch <- c.now
+		return t
+	}
+	i := sort.Search(len(c.waiters), func(i int) bool {
+		return c.waiters[i].deadline.After(w.deadline)
+	})
+	c.waiters = append(c.waiters, nil)
+	copy(c.waiters[i+1:], c.waiters[i:])
+	c.waiters[i] = w
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return t
+}
+
+type simTimer struct {
+	c *SimClock
+	w *simWaiter
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return t.w.ch
+}
+
+// 从等待者中删除, 之后时钟不会为了它推进时间
+func (t *simTimer) Stop() bool {
+	c := t.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, w := range c.waiters {
+		if w == t.w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// 手动推进时间, 唤醒所有到期的 Sleep/After
+func (c *SimClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.advanceLocked(c.now.Add(d))
+}
+
+// 停止自动推进, 之后只能通过 Advance() 推进时间
+func (c *SimClock) Stop() {
+	close(c.stop)
+}
+
+func (c *SimClock) advanceLocked(to time.Time) {
+	c.epoch++
+	if to.After(c.now) {
+		c.now = to
+	}
+	n := 0
+	for n < len(c.waiters) && !c.waiters[n].deadline.After(c.now) {
+		c.waiters[n].ch <- c.now
+		n++
+	}
+	c.waiters = c.waiters[n:]
+}
+
+// 自动推进: 有等待者且时钟空闲时, 跳到最早的到期时刻
+func (c *SimClock) run() {
+	for {
+		c.mu.Lock()
+		epoch := c.epoch
+		pending := len(c.waiters)
+		c.mu.Unlock()
+
+		if pending == 0 {
+			select {
+			case <-c.wake:
+				continue
+			case <-c.stop:
+				return
+			}
+		}
+
+		for i := 0; i < simYields; i++ {
+			runtime.Gosched()
+		}
+		select {
+		case <-time.After(simSettle):
+		case <-c.stop:
+			return
+		}
+
+		c.mu.Lock()
+		if c.epoch == epoch && len(c.waiters) > 0 {
+			c.advanceLocked(c.waiters[0].deadline)
+		}
+		c.mu.Unlock()
+	}
+}
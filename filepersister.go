@@ -0,0 +1,286 @@
+package labrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 状态文件的校验失败, 可能是 torn write 或者文件被破坏
+var ErrCorrupt = errors.New("labrpc: persisted state is corrupt")
+
+// 对已经崩溃或者 Remove() 的 FilePersister 调用 Crash(), 以此 panic
+var ErrCrashed = errors.New("labrpc: persister already crashed or removed")
+
+// 状态文件的格式: crc32(其余部分) | len(state) | state | snapshot
+const (
+	stateFile   = "state"
+	stateHeader = 8
+)
+
+// 崩溃时注入的磁盘故障, 零值表示写入立即持久化
+type CrashFaults struct {
+	LoseUnsynced int     // 崩溃时丢失最后 N 个没有 Sync 的写入, 小于 0 表示全部丢失
+	TornRate     float64 // 崩溃后保留下来的最后一个未 Sync 的写入只写了一部分的概率
+	CorruptRate  float64 // 崩溃后状态文件的一个字节被破坏的概率
+	Seed         int64   // 决定是否发生 torn write/破坏以及发生的位置
+}
+
+// FilePersister 把状态保存在一个目录中, 写入之后需要 Sync() 才能在崩溃时保留
+// 崩溃(Crash/DeleteServer)时按 CrashFaults 丢失或破坏写入, 重启的 FilePersister
+// 从同一个目录加载状态, 校验失败时状态为空, RecoverErr() 返回 ErrCorrupt
+// 目录中只会读写 FilePersister 自己的状态文件
+type FilePersister struct {
+	mu         sync.Mutex
+	dir        string
+	ownsDir    bool // dir 是 MakeFilePersister 创建的临时目录, Remove() 时删除
+	raftstate  []byte
+	snapshot   []byte
+	faults     CrashFaults
+	rand       *rand.Rand
+	durable    []byte   // 崩溃后一定保留下来的文件内容
+	pending    [][]byte // 还没有 Sync 的写入, 只保留 LoseUnsynced+1 个
+	crashed    bool     // 崩溃之后的写入只保存在内存中
+	recoverErr error
+}
+
+// 在 dir 中创建 FilePersister, dir 中已有状态文件时加载它
+// dir 为空时使用一个新的临时目录, 不再使用时调用 Remove() 删除
+func MakeFilePersister(dir string) (*FilePersister, error) {
+	ownsDir := false
+	if dir == "" {
+		d, err := os.MkdirTemp("", "labrpc-persister-")
+		if err != nil {
+			return nil, err
+		}
+		dir = d
+		ownsDir = true
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	fp := &FilePersister{dir: dir, ownsDir: ownsDir, rand: rand.New(rand.NewSource(0))}
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	fp.durable = data
+	if len(data) > 0 {
+		fp.raftstate, fp.snapshot, fp.recoverErr = decodeState(data)
+	}
+	return fp, nil
+}
+
+func encodeState(state []byte, snapshot []byte) []byte {
+	data := make([]byte, stateHeader+len(state)+len(snapshot))
+	binary.BigEndian.PutUint32(data[4:], uint32(len(state)))
+	copy(data[stateHeader:], state)
+	copy(data[stateHeader+len(state):], snapshot)
+	binary.BigEndian.PutUint32(data, crc32.ChecksumIEEE(data[4:]))
+	return data
+}
+
+func decodeState(data []byte) ([]byte, []byte, error) {
+	if len(data) < stateHeader || binary.BigEndian.Uint32(data) != crc32.ChecksumIEEE(data[4:]) {
+		return nil, nil, ErrCorrupt
+	}
+	n := int(binary.BigEndian.Uint32(data[4:]))
+	if n > len(data)-stateHeader {
+		return nil, nil, ErrCorrupt
+	}
+	return clone(data[stateHeader : stateHeader+n]), clone(data[stateHeader+n:]), nil
+}
+
+// 状态文件所在的目录
+func (fp *FilePersister) Dir() string {
+	return fp.dir
+}
+
+// 加载状态文件时发现的错误, ErrCorrupt 表示状态已经丢失
+func (fp *FilePersister) RecoverErr() error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	return fp.recoverErr
+}
+
+// 设置崩溃时注入的故障, 同时重新开始记录未 Sync 的写入
+func (fp *FilePersister) SetCrashFaults(f CrashFaults) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	fp.faults = f
+	fp.rand = rand.New(rand.NewSource(f.Seed))
+	fp.durable = encodeState(fp.raftstate, fp.snapshot)
+	fp.pending = nil
+}
+
+// 模拟 fsync: 之前的写入在崩溃时都会保留
+func (fp *FilePersister) Sync() {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	fp.durable = encodeState(fp.raftstate, fp.snapshot)
+	fp.pending = nil
+}
+
+// 删除状态文件; dir 是 MakeFilePersister 创建的临时目录时删除整个目录
+// 崩溃之后的旧 FilePersister 不再拥有这些文件, Remove() 什么也不做
+func (fp *FilePersister) Remove() error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if fp.crashed {
+		return nil
+	}
+	fp.crashed = true
+	if fp.ownsDir {
+		return os.RemoveAll(fp.dir)
+	}
+	for _, name := range []string{stateFile, stateFile + ".tmp"} {
+		if err := os.Remove(filepath.Join(fp.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// 原子地替换 dir 中的状态文件, data 为空时删除它
+func writeStateFile(dir string, data []byte) error {
+	path := filepath.Join(dir, stateFile)
+	if len(data) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 写入状态文件, 调用者需持有 fp.mu; I/O 错误时 panic
+func (fp *FilePersister) writeLocked() {
+	if fp.crashed {
+		return
+	}
+	data := encodeState(fp.raftstate, fp.snapshot)
+	if err := writeStateFile(fp.dir, data); err != nil {
+		panic(fmt.Errorf("labrpc.FilePersister: %w", err))
+	}
+
+	// 只需要记住崩溃时可能保留下来的写入
+	n := fp.faults.LoseUnsynced
+	if n < 0 {
+		return
+	}
+	fp.pending = append(fp.pending, data)
+	for len(fp.pending) > n+1 {
+		fp.durable = fp.pending[0]
+		fp.pending = fp.pending[1:]
+	}
+}
+
+func (fp *FilePersister) SaveRaftState(state []byte) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	fp.raftstate = clone(state)
+	fp.writeLocked()
+}
+
+func (fp *FilePersister) ReadRaftState() []byte {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	return clone(fp.raftstate)
+}
+
+func (fp *FilePersister) RaftStateSize() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	return len(fp.raftstate)
+}
+
+// 原子地保存 Raft 的状态与快照
+func (fp *FilePersister) SaveStateAndSnapshot(state []byte, snapshot []byte) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	fp.raftstate = clone(state)
+	fp.snapshot = clone(snapshot)
+	fp.writeLocked()
+}
+
+func (fp *FilePersister) ReadSnapshot() []byte {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	return clone(fp.snapshot)
+}
+
+func (fp *FilePersister) SnapshotSize() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	return len(fp.snapshot)
+}
+
+// 模拟崩溃: 按 CrashFaults 决定磁盘上留下的内容, 重写同一个目录中的状态文件并从中加载
+// 原来的 FilePersister 之后的写入只保存在内存中, 不会影响返回的 FilePersister
+// 重复 Crash() 时以 ErrCrashed panic, I/O 错误时以该错误 panic
+func (fp *FilePersister) Crash() Storage {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if fp.crashed {
+		// 状态文件已经属于重启后的 FilePersister
+		panic(fmt.Errorf("labrpc.FilePersister.Crash(): %w: %v", ErrCrashed, fp.dir))
+	}
+
+	data := fp.durable
+	if n := fp.faults.LoseUnsynced; n >= 0 {
+		if i := len(fp.pending) - 1 - n; i >= 0 {
+			data = fp.pending[i]
+			prev := fp.durable
+			if i > 0 {
+				prev = fp.pending[i-1]
+			}
+			if len(data) > 0 && fp.rand.Float64() < fp.faults.TornRate {
+				// 只有前一部分写到了磁盘上, 其余部分还是之前的内容
+				cut := fp.rand.Intn(len(data))
+				torn := clone(data[:cut])
+				if len(prev) > cut {
+					torn = append(torn, prev[cut:]...)
+				}
+				data = torn
+			}
+		}
+	}
+	if len(data) > 0 && fp.rand.Float64() < fp.faults.CorruptRate {
+		data = clone(data)
+		data[fp.rand.Intn(len(data))] ^= 0xff
+	}
+
+	fp.crashed = true
+	if err := writeStateFile(fp.dir, data); err != nil {
+		panic(fmt.Errorf("labrpc.FilePersister.Crash(): %w", err))
+	}
+	np, err := MakeFilePersister(fp.dir)
+	if err != nil {
+		panic(fmt.Errorf("labrpc.FilePersister.Crash(): %w", err))
+	}
+	// 临时目录交给重启后的 FilePersister 删除
+	np.ownsDir = fp.ownsDir
+	np.faults = fp.faults
+	np.rand = rand.New(rand.NewSource(fp.rand.Int63()))
+	return np
+}
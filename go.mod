@@ -0,0 +1,3 @@
+module github.com/shockcoder/rpc-realize
+
+go 1.16
@@ -2,10 +2,15 @@ package labrpc
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -17,26 +22,201 @@ import (
 // 改编自 Go net/rpc/server.go
 
 type reqMsg struct {
-	endname  interface{}   // 请求的客户端名字
-	svcMeth  string        // 方法 e.g. "Raft.AppendEntries" 通过反射去运行指定的方法
-	argsType reflect.Type  //参数类型反射
-	args     []byte        //序列化参数
-	replyCh  chan replyMsg //client、server 通信channel
+	endname    interface{}     // 请求的客户端名字
+	svcMeth    string          // 方法 e.g. "Raft.AppendEntries" 通过反射去运行指定的方法
+	argsType   reflect.Type    //参数类型反射
+	args       []byte          //序列化参数
+	replyCh    chan replyMsg   //client、server 通信channel
+	done       <-chan struct{} //客户端放弃等待时关闭, 网络不再尝试回复
+	sent       time.Time       //发送时间
+	id         uint64          //请求编号, 由 Network 分配
+	servername interface{}     //处理请求的 server, 由 Network 填写
+	header     Metadata        //随请求发送的元数据
+	received   time.Time       //Network 收到请求的时间, 用于统计
+	rand       *rand.Rand      //该请求的故障决策使用的随机数, 由 Network 按请求顺序派生
 }
 
 type replyMsg struct {
-	ok    bool   //success or false
-	reply []byte //result data serialize
+	ok      bool     //success or false
+	reply   []byte   //result data serialize
+	err     error    //失败的原因; ok 为 true 时是 handler 返回的 ServerError
+	trailer Metadata //随回复返回的元数据
+
+	handlerTime time.Duration //handler 的执行时间, 用于统计
+	delivered   func()        //客户端收到回复后调用, 在 Call 返回之前记录统计数据
 }
 
 type ClientEnd struct {
 	endname interface{} //客户端的名字
 	ch      chan reqMsg
+	net     *Network
+
+	mu           sync.Mutex
+	interceptors []ClientInterceptor
+}
+
+// Invoker 发送一次 RPC, 结果写入 call.Reply
+type Invoker func(ctx context.Context, call *Call) error
+
+// ClientInterceptor 包装 ClientEnd 发出的每一次调用 (Call/CallErr/CallContext/Go)
+// 可以在调用 invoke 之前或之后检查 call, 多次调用 invoke 实现重试, 或者不调用 invoke 直接返回
+type ClientInterceptor func(ctx context.Context, e *ClientEnd, call *Call, invoke Invoker) error
+
+// 返回客户端的名字
+func (e *ClientEnd) Name() interface{} {
+	return e.endname
+}
+
+// Use 为该客户端注册 interceptor, 先注册的在外层
+// Network.UseClient() 注册的 interceptor 总是在这些 interceptor 的外层
+func (e *ClientEnd) Use(interceptors ...ClientInterceptor) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.interceptors = append(append([]ClientInterceptor{}, e.interceptors...), interceptors...)
+}
+
+// CallErr / CallContext 返回的错误, 可以用 errors.Is 判断
+var (
+	ErrDropped        = errors.New("labrpc: request or reply dropped by the network")
+	ErrDisabled       = errors.New("labrpc: client end is disabled")
+	ErrPartitioned    = errors.New("labrpc: client end is partitioned from the server")
+	ErrNoServer       = errors.New("labrpc: client end is not connected to a server")
+	ErrServerDead     = errors.New("labrpc: server was deleted during the call")
+	ErrUnknownService = errors.New("labrpc: unknown service")
+	ErrUnknownMethod  = errors.New("labrpc: unknown method")
+	ErrDecode         = errors.New("labrpc: cannot decode reply")
+	ErrHandler        = errors.New("labrpc: handler returned an error")
+	ErrPanicked       = errors.New("labrpc: handler panicked")
+	ErrArgType        = errors.New("labrpc: interceptor passed args or reply of the wrong type")
+)
+
+// 丢包的位置, errors.Is(err, ErrDropped) 均为 true
+// ErrReplyLost 表示 handler 已经执行, 对非幂等的 handler 需要特别小心
+// handler 执行之后客户端被禁用、被分区或者 server 被删除时, 错误同样满足 errors.Is(err, ErrReplyLost)
+var (
+	ErrRequestLost error = &lossError{"labrpc: request dropped by the network before reaching the server"}
+	ErrReplyLost   error = &lossError{"labrpc: reply dropped by the network after the handler ran"}
+)
+
+type lossError struct {
+	msg string
+}
+
+func (e *lossError) Error() string {
+	return e.msg
 }
 
+func (e *lossError) Is(target error) bool {
+	return target == ErrDropped
+}
+
+// handler 已经执行(或者仍在执行), 但是回复因为 err 没有送达客户端
+// errors.Is(e, ErrReplyLost) 与 errors.Is(e, err) 均为 true
+type executedError struct {
+	err error
+}
+
+func executed(err error) error {
+	if err == nil {
+		// 调用者保证 err 不为 nil, 这里只是防止 Error() 解引用 nil
+		err = ErrReplyLost
+	}
+	return &executedError{err}
+}
+
+func (e *executedError) Error() string {
+	return e.err.Error() + " (after the handler ran)"
+}
+
+func (e *executedError) Unwrap() error {
+	return e.err
+}
+
+func (e *executedError) Is(target error) bool {
+	return target == ErrReplyLost || target == ErrDropped
+}
+
+// Server.AddService 的错误
+var ErrDuplicateService = errors.New("labrpc: service already registered")
+
+// handler 返回的错误, 跨越模拟网络后只保留错误信息
+// errors.Is(err, ErrHandler) 为 true
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+func (e ServerError) Is(target error) bool {
+	return target == ErrHandler
+}
+
+// 调用了不存在的 service/method, 或者回复无法解码时的处理方式
+// 这类错误通常是代码的 bug, 而不是网络故障
+type FailurePolicy int
+
+const (
+	FailFatal FailurePolicy = iota // log.Fatalf 结束进程, 默认行为
+	FailPanic                      // 在调用者的 goroutine 中 panic; Go() 的错误只写入 Call.Error
+	FailReply                      // 把错误返回给调用者, Call 返回 false
+)
+
 // 发送 rpc请求，等待回复
-// 返回值意味着成功，失败则表示 服务不可连接
+// 返回值意味着成功，失败则表示 服务不可连接或 handler 返回了错误
 func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return e.CallErr(svcMeth, args, reply) == nil
+}
+
+// 同 Call, 失败时返回具体的原因
+func (e *ClientEnd) CallErr(svcMeth string, args interface{}, reply interface{}, opts ...CallOption) error {
+	return e.CallContext(context.Background(), svcMeth, args, reply, opts...)
+}
+
+// 发送 rpc请求，等待回复, ctx 被取消或超时时立即返回 ctx.Err()
+func (e *ClientEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}, opts ...CallOption) error {
+	call := &Call{
+		ServiceMethod: svcMeth,
+		Args:          args,
+		Reply:         reply,
+		Sent:          e.net.Clock().Now(),
+	}
+	for _, opt := range opts {
+		opt(call)
+	}
+	e.invoke(ctx, call)
+	return e.net.fail(call.Error, false)
+}
+
+// 经过所有 interceptor 发送 call, 结果写入 call.Error 与 call.Finished
+func (e *ClientEnd) invoke(ctx context.Context, call *Call) {
+	e.net.mu.Lock()
+	interceptors := e.net.clientInterceptors
+	e.net.mu.Unlock()
+	e.mu.Lock()
+	if len(e.interceptors) > 0 {
+		interceptors = append(append([]ClientInterceptor{}, interceptors...), e.interceptors...)
+	}
+	e.mu.Unlock()
+
+	invoke := Invoker(e.send)
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoke
+		invoke = func(ctx context.Context, call *Call) error {
+			return interceptor(ctx, e, call, next)
+		}
+	}
+	call.Error = invoke(ctx, call)
+	call.Finished = e.net.Clock().Now()
+	if call.trailer != nil {
+		*call.trailer = call.Trailer
+	}
+}
+
+// 把 call 交给网络, 等待回复
+func (e *ClientEnd) send(ctx context.Context, call *Call) error {
+	svcMeth, args, reply := call.ServiceMethod, call.Args, call.Reply
+
 	//序列化请求参数args
 	qb := new(bytes.Buffer)
 	encoder := gob.NewEncoder(qb)
@@ -50,52 +230,267 @@ func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bo
 		argsType: reflect.TypeOf(args),
 		args:     qb.Bytes(),
 		replyCh:  replyCh, //该channel用于clent、server 通信
+		done:     ctx.Done(),
+		sent:     e.net.Clock().Now(),
+		header:   call.Header.copy(),
 	}
 
-	e.ch <- req //往channel中写入请求信息
+	//往channel中写入请求信息
+	select {
+	case e.ch <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
-	resp := <-req.replyCh //通过channel用于接收server返回的信息
+	//通过channel用于接收server返回的信息
+	var resp replyMsg
+	select {
+	case resp = <-req.replyCh:
+		resp.delivered()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	call.Trailer = resp.trailer.copy()
+	if resp.ok && resp.err != nil {
+		// handler 返回了错误, 没有返回值
+		return resp.err
+	}
 	if resp.ok {
 		rb := bytes.NewBuffer(resp.reply) //反序列化获取返回信息
 		decoder := gob.NewDecoder(rb)
 		if err := decoder.Decode(reply); err != nil {
-			log.Fatalf("ClientEnd.Call(): decode reply : %v\n", err)
+			return fmt.Errorf("%w: %v", ErrDecode, err)
 		}
-		return true
+		return nil
+	}
+	return resp.err
+}
+
+// Metadata 是随请求与回复传输的元数据, 例如 trace ID、client ID、序列号
+// 经过网络时会被复制, 两端修改各自的副本互不影响
+type Metadata map[string]string
+
+func (md Metadata) copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	c := Metadata{}
+	for k, v := range md {
+		c[k] = v
 	}
-	return false
+	return c
 }
 
+// CallOption 设置一次调用的可选参数
+type CallOption func(call *Call)
+
+// 随请求发送的元数据, handler 与服务端 interceptor 通过 CallInfo.Header 读取
+func WithHeader(md Metadata) CallOption {
+	return func(call *Call) {
+		if call.Header == nil {
+			call.Header = Metadata{}
+		}
+		for k, v := range md {
+			call.Header[k] = v
+		}
+	}
+}
+
+// 调用完成后把 handler 写入 CallInfo.Trailer 的元数据保存到 *md
+func WithTrailer(md *Metadata) CallOption {
+	return func(call *Call) {
+		call.trailer = md
+	}
+}
+
+// Call 表示一次 RPC, 由 ClientEnd.Go() 返回, 也是 ClientInterceptor 看到的调用
+type Call struct {
+	ServiceMethod string      // 调用的方法 e.g. "Raft.AppendEntries"
+	Args          interface{} // 参数
+	Reply         interface{} // 返回值, 调用完成后有效
+	Error         error       // 调用完成后的错误, nil 表示成功
+	Done          chan *Call  // 调用完成后 Call 会被写入该 channel
+	Sent          time.Time   // 发送时间, 由 Network 的 Clock 给出
+	Finished      time.Time   // 完成时间
+	Header        Metadata    // 随请求发送的元数据
+	Trailer       Metadata    // 随回复返回的元数据, 调用完成后有效
+
+	trailer *Metadata // WithTrailer() 的目标
+}
+
+// 异步地发送 rpc请求, 完成后把 Call 写入 done
+// done 为 nil 时会新建一个有缓冲的 channel; 否则 done 必须有缓冲
+func (e *ClientEnd) Go(svcMeth string, args interface{}, reply interface{}, done chan *Call, opts ...CallOption) *Call {
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		log.Panic("labrpc: ClientEnd.Go(): done channel is unbuffered")
+	}
+
+	call := &Call{
+		ServiceMethod: svcMeth,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
+		Sent:          e.net.Clock().Now(),
+	}
+	for _, opt := range opts {
+		opt(call)
+	}
+	go func() {
+		e.invoke(context.Background(), call)
+		call.Error = e.net.fail(call.Error, true)
+		select {
+		case call.Done <- call:
+		default:
+			// 与 net/rpc 一致, 调用者需要保证 done 有足够的缓冲
+			log.Printf("labrpc: ClientEnd.Go(): discarding Call reply due to insufficient Done chan capacity")
+		}
+	}()
+	return call
+}
+
+// UseClient 注册所有客户端共用的 interceptor, 先注册的在外层
+func (rn *Network) UseClient(interceptors ...ClientInterceptor) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.clientInterceptors = append(append([]ClientInterceptor{}, rn.clientInterceptors...), interceptors...)
+}
+
+// 设置未知的 service/method 与回复解码失败时的处理方式, 默认为 FailFatal
+func (rn *Network) SetFailurePolicy(p FailurePolicy) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.failPolicy = p
+}
+
+// 在调用者的 goroutine 中按照 FailurePolicy 处理 Call 的错误
+// async 表示在 Go() 的 goroutine 中, 调用者无法 recover, FailPanic 时只返回错误
+func (rn *Network) fail(err error, async bool) error {
+	if !errors.Is(err, ErrUnknownService) && !errors.Is(err, ErrUnknownMethod) && !errors.Is(err, ErrDecode) {
+		return err
+	}
+
+	rn.mu.Lock()
+	policy := rn.failPolicy
+	rn.mu.Unlock()
+
+	switch policy {
+	case FailFatal:
+		log.Fatalf("ClientEnd.Call(): %v\n", err)
+	case FailPanic:
+		if !async {
+			panic(err)
+		}
+	}
+	return err
+}
+
+// LinkProfile 描述一条链路的故障特征
+// 零值表示一条可靠、无延迟的链路
+type LinkProfile struct {
+	RequestLoss   float64       // 请求在到达 server 之前被丢弃的概率
+	ReplyLoss     float64       // handler 执行之后回复被丢弃的概率
+	Latency       time.Duration // 请求的固定延迟
+	Jitter        time.Duration // 在 Latency 之上均匀分布的随机延迟 [0, Jitter)
+	ReorderRate   float64       // 回复被额外延迟(从而乱序)的概率
+	ReorderMin    time.Duration // 乱序时额外延迟的下限
+	ReorderMax    time.Duration // 乱序时额外延迟的上限, 偏向 ReorderMin 分布
+	DuplicateRate float64       // 请求被重复投递给 server 的概率, 客户端只会收到一个回复
+	Unreachable   time.Duration // 请求不可达(客户端被禁用、没有 server 或被分区)时, 返回错误之前的随机延迟 [0, Unreachable)
+}
+
+// Reliable(false)、LongRecording(true) 与 LongDelays() 使用的参数
+const (
+	unreliableLoss   = 0.1
+	unreliableJitter = 27 * time.Millisecond
+	reorderRate      = 600.0 / 900.0
+	reorderMin       = 200 * time.Millisecond
+	reorderMax       = 2200 * time.Millisecond
+	shortUnreachable = 100 * time.Millisecond
+	longUnreachable  = 7000 * time.Millisecond
+)
+
 type Network struct {
-	mu              sync.Mutex
-	reliable        bool
-	longDelays      bool                        //连接不可达时,停顿一段时间
-	longRecordering bool                        //延迟回复的时间
-	ends            map[interface{}]*ClientEnd  //客户端的 map集合 key: name of ClientEnd
-	enabled         map[interface{}]bool        //by end name
-	servers         map[interface{}]*Server     //服务器, by name
-	connections     map[interface{}]interface{} //客户端 -> 服务端
-	endCh           chan reqMsg
+	mu             sync.Mutex
+	profile        LinkProfile                    //全局的链路特征
+	endProfiles    map[interface{}]LinkProfile    //by end name
+	serverProfiles map[interface{}]LinkProfile    //by server name
+	linkProfiles   map[[2]interface{}]LinkProfile //by (end name, server name)
+	ends           map[interface{}]*ClientEnd     //客户端的 map集合 key: name of ClientEnd
+	enabled        map[interface{}]bool           //by end name
+	servers        map[interface{}]*Server        //服务器, by name
+	connections    map[interface{}]interface{}    //客户端 -> 服务端
+	persisters     map[interface{}]Storage        //by server name
+	cuts           map[[2]interface{}]bool        //分区: 被切断的 (end, server)
+	endCh          chan reqMsg
+	seed           int64      //随机数种子, 用于复现故障
+	rand           *rand.Rand //只在处理请求的 goroutine 中使用
+	clock          Clock
+	skews          map[interface{}]time.Duration //ServerClock 的时钟偏移, by server name
+	failPolicy     FailurePolicy
+
+	clientInterceptors []ClientInterceptor //所有客户端共用的 interceptor
+
+	stats *netStats
+}
+
+// MakeNetWork 的可选参数
+type Option func(rn *Network)
+
+// 使用指定的种子, 相同的种子与相同的请求顺序会得到相同的故障决策
+func WithSeed(seed int64) Option {
+	return func(rn *Network) {
+		rn.seed = seed
+		rn.rand = rand.New(rand.NewSource(seed))
+	}
+}
+
+// 使用自定义的随机数源, 此时 Seed() 返回 0
+func WithRandSource(src rand.Source) Option {
+	return func(rn *Network) {
+		rn.seed = 0
+		rn.rand = rand.New(src)
+	}
 }
 
 // 模拟一个网络
 // 该网络包含客户端和服务端
-func MakeNetWork() *Network {
+func MakeNetWork(opts ...Option) *Network {
 
 	endCh := make(chan reqMsg)
 
 	rn := &Network{
-		reliable:    true,
-		ends:        map[interface{}]*ClientEnd{},
-		enabled:     map[interface{}]bool{},
-		servers:     map[interface{}]*Server{},
-		connections: map[interface{}]interface{}{},
-		endCh:       endCh,
+		profile:        LinkProfile{Unreachable: shortUnreachable},
+		endProfiles:    map[interface{}]LinkProfile{},
+		serverProfiles: map[interface{}]LinkProfile{},
+		linkProfiles:   map[[2]interface{}]LinkProfile{},
+		ends:           map[interface{}]*ClientEnd{},
+		enabled:        map[interface{}]bool{},
+		servers:        map[interface{}]*Server{},
+		connections:    map[interface{}]interface{}{},
+		persisters:     map[interface{}]Storage{},
+		cuts:           map[[2]interface{}]bool{},
+		endCh:          endCh,
+		clock:          realClock{},
+		skews:          map[interface{}]time.Duration{},
+		stats:          makeNetStats(),
+	}
+	WithSeed(time.Now().UnixNano())(rn)
+	for _, opt := range opts {
+		opt(rn)
 	}
 
 	//开启一个goroutine 来处理所有的客户端的请求(Client.Call())
+	//每个请求的随机数在这里按顺序派生, 保证结果不受 goroutine 调度的影响
 	go func() {
+		var id uint64
 		for xreq := range rn.endCh {
+			id++
+			xreq.id = id
+			xreq.rand = rand.New(&splitMix64{uint64(rn.rand.Int63())})
 			go rn.ProcessReq(xreq)
 		}
 	}()
@@ -103,74 +498,228 @@ func MakeNetWork() *Network {
 	return rn
 }
 
+// 返回随机数种子, 测试失败时打印出来便于复现
+func (rn *Network) Seed() int64 {
+	return rn.seed
+}
+
+// splitMix64 是一个轻量的 rand.Source, 每个请求一个
+// rand.NewSource 的初始化开销太大, 不适合每个请求都创建
+type splitMix64 struct {
+	state uint64
+}
+
+func (s *splitMix64) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *splitMix64) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
 func (rn *Network) Reliable(yes bool) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	rn.reliable = yes
+	if yes {
+		rn.profile.RequestLoss = 0
+		rn.profile.ReplyLoss = 0
+		rn.profile.Jitter = 0
+	} else {
+		rn.profile.RequestLoss = unreliableLoss
+		rn.profile.ReplyLoss = unreliableLoss
+		rn.profile.Jitter = unreliableJitter
+	}
+}
+
+// 请求在到达 server 之前被丢弃的概率, 与 Reliable() 一样修改全局的链路特征
+func (rn *Network) SetRequestLoss(rate float64) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.profile.RequestLoss = rate
+}
+
+// handler 执行之后回复被丢弃的概率
+func (rn *Network) SetReplyLoss(rate float64) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.profile.ReplyLoss = rate
 }
 
 func (rn *Network) LongRecording(yes bool) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	rn.longRecordering = yes
+	if yes {
+		rn.profile.ReorderRate = reorderRate
+		rn.profile.ReorderMin = reorderMin
+		rn.profile.ReorderMax = reorderMax
+	} else {
+		rn.profile.ReorderRate = 0
+		rn.profile.ReorderMin = 0
+		rn.profile.ReorderMax = 0
+	}
 }
 
+// 连接不可达时停顿更长的时间, 修改全局的链路特征
 func (rn *Network) LongDelays(yes bool) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	rn.longDelays = yes
+	if yes {
+		rn.profile.Unreachable = longUnreachable
+	} else {
+		rn.profile.Unreachable = shortUnreachable
+	}
+}
+
+// 设置全局的链路特征, 会覆盖 Reliable()、LongRecording() 与 LongDelays() 的设置
+func (rn *Network) SetProfile(p LinkProfile) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.profile = p
+}
+
+// 设置某个客户端发出的所有请求的链路特征
+func (rn *Network) SetEndProfile(endname interface{}, p LinkProfile) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.endProfiles[endname] = p
+}
+
+// 设置发往某个 server 的所有请求的链路特征
+func (rn *Network) SetServerProfile(servername interface{}, p LinkProfile) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.serverProfiles[servername] = p
+}
+
+// 设置 endname -> servername 这条链路的特征
+func (rn *Network) SetLinkProfile(endname interface{}, servername interface{}, p LinkProfile) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.linkProfiles[[2]interface{}{endname, servername}] = p
+}
+
+// 删除所有 per end/server/link 的设置, 只保留全局的链路特征
+func (rn *Network) ClearProfiles() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.endProfiles = map[interface{}]LinkProfile{}
+	rn.serverProfiles = map[interface{}]LinkProfile{}
+	rn.linkProfiles = map[[2]interface{}]LinkProfile{}
+}
+
+// 查找一条链路生效的特征, 优先级: link > end > server > 全局
+// 调用者需持有 rn.mu
+func (rn *Network) profileLocked(endname interface{}, servername interface{}) LinkProfile {
+	if p, ok := rn.linkProfiles[[2]interface{}{endname, servername}]; ok {
+		return p
+	}
+	if p, ok := rn.endProfiles[endname]; ok {
+		return p
+	}
+	if p, ok := rn.serverProfiles[servername]; ok {
+		return p
+	}
+	return rn.profile
 }
 
-func (rn *Network) ReadEndnameInfo(endname interface{}) (enabled bool, servername interface{},
-	server *Server, reliable bool, longreordering bool) {
+// 读取客户端连接的 server 与链路特征, 客户端无法发出请求时 err 给出原因
+func (rn *Network) ReadEndnameInfo(endname interface{}) (servername interface{},
+	server *Server, profile LinkProfile, err error) {
 
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	enabled = rn.enabled[endname]
 	servername = rn.connections[endname]
 	if servername != nil {
 		server = rn.servers[servername]
 	}
-	reliable = rn.reliable
-	longreordering = rn.longRecordering
+	profile = rn.profileLocked(endname, servername)
+
+	if rn.enabled[endname] == false {
+		err = ErrDisabled
+	} else if servername == nil || server == nil {
+		err = ErrNoServer
+	} else if rn.isCut(endname, servername) {
+		err = ErrPartitioned
+	}
 	return
 }
 
 func (rn *Network) IsServerDead(endname interface{}, servername interface{}, server *Server) bool {
+	return rn.checkServer(endname, servername, server) != nil
+}
+
+// 请求处理过程中检查客户端与 server 之间是否仍然连通
+func (rn *Network) checkServer(endname interface{}, servername interface{}, server *Server) error {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	if rn.enabled[endname] == false || rn.servers[servername] != server {
-		return true
+	if rn.enabled[endname] == false {
+		return ErrDisabled
 	}
-
-	return false
+	if rn.servers[servername] != server {
+		return ErrServerDead
+	}
+	if rn.isCut(endname, servername) {
+		return ErrPartitioned
+	}
+	return nil
 }
 
 func (rn *Network) ProcessReq(req reqMsg) {
-	enabled, servername, server, reliable, longrecordering := rn.ReadEndnameInfo(req.endname)
-
-	if enabled && servername != nil && server != nil {
-		if reliable == false {
-			// 短暂的延迟, 等待响应
-			ms := rand.Int() % 27
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+	servername, server, profile, err := rn.ReadEndnameInfo(req.endname)
+	req.servername = servername
+	req.received = rn.clock.Now()
+	rn.stats.request(req)
+
+	if err == nil {
+		// 链路延迟
+		delay := profile.Latency
+		if profile.Jitter > 0 {
+			delay += time.Duration(req.rand.Int63n(int64(profile.Jitter)))
+		}
+		if rn.sleep(req, delay) == false {
+			rn.abandon(req)
+			return
 		}
 
-		if reliable == false && rand.Int()%1000 < 100 {
-			req.replyCh <- replyMsg{false, nil} // 如果超时，删除这个请求并返回 空的replyMsg
+		if req.rand.Float64() < profile.RequestLoss {
+			rn.reply(req, replyMsg{err: ErrRequestLost}) // 如果超时，删除这个请求并返回 空的replyMsg
 			return
 		}
 
+		if profile.DuplicateRate > 0 && req.rand.Float64() < profile.DuplicateRate {
+			// 重复的请求在 [0, Latency+Jitter] 之后到达, 可能与原请求并发执行
+			extra := time.Duration(req.rand.Int63n(int64(profile.Latency+profile.Jitter) + 1))
+			go rn.duplicate(req, servername, server, extra)
+		}
+
 		// 响应客户端发来的请求(call the RPC handler) 开启一个协程去处理
 		// 当服务不可用，  RPC请求 应该得到一个请求失败的reply
-		ech := make(chan replyMsg)
+		// ech 有缓冲, 客户端放弃等待后 handler 的 goroutine 也能退出
+		ech := make(chan replyMsg, 1)
 		go func() {
+			t0 := rn.clock.Now()
 			r := server.dispatch(req)
+			r.handlerTime = rn.clock.Now().Sub(t0)
 			ech <- r
 		}()
 
@@ -178,49 +727,124 @@ func (rn *Network) ProcessReq(req reqMsg) {
 		// 当DeleteServer()函数被执行时， 停止等待并返回一个错误
 		var reply replyMsg
 		replyOK := false
-		serverDead := false
-		for replyOK == false && serverDead == false {
+		var deadErr error
+		for replyOK == false && deadErr == nil {
+			// 处理器返回后停止定时器, 使用 SimClock 时不会因此推进时间
+			t := rn.clock.NewTimer(100 * time.Millisecond)
 			select {
 			case reply = <-ech:
 				replyOK = true
-			case <-time.After(100 * time.Millisecond):
-				serverDead = rn.IsServerDead(req.endname, servername, server)
+			case <-t.C():
+				deadErr = rn.checkServer(req.endname, servername, server)
+			case <-req.done:
+				t.Stop()
+				rn.abandon(req)
+				return
 			}
+			t.Stop()
 		}
 
 		// 当DeleteServer()被执行，即服务器被杀死, 不用回复客户端请求
 		// 这是为了避免客户端对Append的肯定回复的情况
 		// 但是服务器将更新持久保存的保存到旧的Persister中.在执行DeleteServer()之前请慎重考虑
-		serverDead = rn.IsServerDead(req.endname, servername, server)
+		// 只在再次检查发现故障时覆盖, 循环中发现的故障可能已经恢复
+		if err := rn.checkServer(req.endname, servername, server); err != nil {
+			deadErr = err
+		}
 
-		if replyOK == false || serverDead == true {
+		if replyOK == false || deadErr != nil {
 			// server was killed while we were waiting
-			req.replyCh <- replyMsg{false, nil}
-		} else if reliable == false && (rand.Int()%1000 < 100) {
-			// 响应超时，放弃回复
-			req.replyCh <- replyMsg{false, nil}
-		} else if longrecordering == true && rand.Intn(900) < 600 {
+			// handler 已经开始执行, 即使网络不再等待它也会执行完
+			rn.reply(req, replyMsg{err: executed(deadErr)})
+		} else if reply.ok == false {
+			// 找不到 service/method 或者 service 已被删除, 总是通知客户端
+			rn.reply(req, reply)
+		} else if req.rand.Float64() < profile.ReplyLoss {
+			// 响应超时，放弃回复; handler 已经执行过了
+			rn.reply(req, replyMsg{err: ErrReplyLost})
+		} else if req.rand.Float64() < profile.ReorderRate {
 			// 延长一点响应时间
-			ms := 200 + rand.Intn(1+rand.Intn(2000))
-			time.Sleep(time.Duration(ms) * time.Millisecond)
-			req.replyCh <- reply
+			if rn.sleep(req, reorderDelay(req.rand, profile)) {
+				rn.reply(req, reply)
+			} else {
+				rn.abandon(req)
+			}
 		} else {
-			req.replyCh <- reply
+			rn.reply(req, reply)
 		}
 	} else {
 		// 模拟没有回复 和 超时
-		ms := 0
-		if rn.longDelays {
-			ms = rand.Int() % 7000
+		var delay time.Duration
+		if profile.Unreachable > 0 {
+			delay = time.Duration(req.rand.Int63n(int64(profile.Unreachable)))
+		}
+		if rn.sleep(req, delay) {
+			rn.reply(req, replyMsg{err: err})
 		} else {
-			//模拟请求快速响应
-			ms = rand.Int() % 100
+			rn.abandon(req)
 		}
-		time.Sleep(time.Duration(ms) * time.Millisecond)
-		req.replyCh <- replyMsg{false, nil}
 	}
 }
 
+// 再次把请求交给 server 执行, 回复被丢弃
+// 客户端是否放弃等待与重复的请求无关, 只要 server 仍然可达就会执行
+func (rn *Network) duplicate(req reqMsg, servername interface{}, server *Server, delay time.Duration) {
+	rn.clock.Sleep(delay)
+	if rn.checkServer(req.endname, servername, server) != nil {
+		return
+	}
+	req.header = req.header.copy()
+	rn.stats.duplicate(req)
+	server.dispatch(req)
+}
+
+// 模拟网络延迟, 客户端放弃等待时提前返回 false
+func (rn *Network) sleep(req reqMsg, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := rn.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-req.done:
+		return false
+	}
+}
+
+// 把结果交给客户端, 客户端已经放弃等待则丢弃
+func (rn *Network) reply(req reqMsg, msg replyMsg) {
+	if msg.ok == false && msg.err == nil {
+		// 否则客户端会把没有回复的请求当作成功
+		panic("labrpc: failed reply without an error")
+	}
+	total := rn.clock.Now().Sub(req.received)
+	stats := msg
+	msg.delivered = func() {
+		rn.stats.finish(req, stats, true, total)
+	}
+	select {
+	case req.replyCh <- msg:
+	case <-req.done:
+		rn.stats.finish(req, stats, false, total)
+	}
+}
+
+// 客户端在网络回复之前放弃了等待
+func (rn *Network) abandon(req reqMsg) {
+	rn.stats.finish(req, replyMsg{}, false, rn.clock.Now().Sub(req.received))
+}
+
+// 乱序时回复的额外延迟, 在 [ReorderMin, ReorderMax] 之间且偏向 ReorderMin
+func reorderDelay(r *rand.Rand, p LinkProfile) time.Duration {
+	d := p.ReorderMin
+	if span := int64(p.ReorderMax - p.ReorderMin); span > 0 {
+		d += time.Duration(r.Int63n(1 + r.Int63n(span)))
+	}
+	return d
+}
+
 // 为该网络创建一个客户端
 func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
 	rn.mu.Lock()
@@ -233,6 +857,7 @@ func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
 	e := &ClientEnd{
 		endname: endname,
 		ch:      rn.endCh,
+		net:     rn,
 	}
 	rn.ends[endname] = e
 	rn.enabled[endname] = false
@@ -248,11 +873,17 @@ func (rn *Network) AddServer(servername interface{}, rs *Server) {
 	rn.servers[servername] = rs
 }
 
+// 删除 server, 模拟崩溃
+// server 的存储被换成 Crash() 的结果, 被删除的 server 之后的写入不会被重启的 server 看到
+// FilePersister 还可能丢失没有 Sync 的写入
 func (rn *Network) DeleteServer(servername interface{}) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
 	rn.servers[servername] = nil
+	if s, ok := rn.persisters[servername]; ok {
+		rn.persisters[servername] = s.Crash()
+	}
 }
 
 // 将一个客户端连接到 server
@@ -272,6 +903,53 @@ func (rn *Network) Enable(endname interface{}, enabled bool) {
 	rn.enabled[endname] = enabled
 }
 
+// 将网络划分为若干分组, 跨分组的请求会被丢弃
+// 分组成员可以是 end name 或 server name, 未出现在任何分组中的成员不受影响
+// 新的分区会替换之前所有的分区
+func (rn *Network) Partition(groups ...[]interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.cuts = map[[2]interface{}]bool{}
+	for i, gi := range groups {
+		for j, gj := range groups {
+			if i != j {
+				rn.cutLocked(gi, gj)
+			}
+		}
+	}
+}
+
+// 单向分区: from 中的 end 发往 to 中的 server 的请求被丢弃, 反方向不受影响
+// 与已有的分区叠加
+func (rn *Network) PartitionOneWay(from []interface{}, to []interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.cutLocked(from, to)
+}
+
+// 撤销所有分区
+func (rn *Network) Heal() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.cuts = map[[2]interface{}]bool{}
+}
+
+func (rn *Network) cutLocked(from []interface{}, to []interface{}) {
+	for _, a := range from {
+		for _, b := range to {
+			rn.cuts[[2]interface{}{a, b}] = true
+		}
+	}
+}
+
+// 判断 endname -> servername 的请求是否被分区切断, 调用者需持有 rn.mu
+func (rn *Network) isCut(endname interface{}, servername interface{}) bool {
+	return rn.cuts[[2]interface{}{endname, servername}]
+}
+
 // 获取连接server的rpcs 的数量
 func (rn *Network) GetCount(servername interface{}) int {
 	rn.mu.Lock()
@@ -286,19 +964,111 @@ func (rn *Network) GetCount(servername interface{}) int {
 type Server struct {
 	mu       sync.Mutex
 	services map[string]*Service
-	count    int //连接的 RPCs
+	removed  map[string]chan struct{} //service 被删除或替换时关闭, 正在执行的请求随之失败
+	dropped  map[string]bool          //被 RemoveService 删除的 service, 之后的请求以 ErrServerDead 失败
+	count    int                      //连接的 RPCs
+
+	interceptors []Interceptor // 按注册顺序包装所有 handler
+
+	recoverPanics bool          // 是否捕获 handler 的 panic
+	panics        []PanicRecord // 捕获到的 panic
+	crashed       bool          // handler panic 之后 server 不再处理请求
+}
+
+// handler panic 的记录
+type PanicRecord struct {
+	ServiceMethod string
+	EndName       interface{}
+	Value         interface{} // recover() 的返回值
+	Stack         []byte
 }
 
 func MakeServer() *Server {
 	rs := &Server{}
 	rs.services = map[string]*Service{}
+	rs.removed = map[string]chan struct{}{}
+	rs.dropped = map[string]bool{}
 	return rs
 }
 
-func (rs *Server) AddService(svc *Service) {
+// AddService 注册一个 service, 同名的 service 已经存在时返回 ErrDuplicateService
+func (rs *Server) AddService(svc *Service) error {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
+
+	if _, ok := rs.services[svc.name]; ok {
+		return fmt.Errorf("%w: %v", ErrDuplicateService, svc.name)
+	}
 	rs.services[svc.name] = svc
+	rs.removed[svc.name] = make(chan struct{})
+	delete(rs.dropped, svc.name)
+	return nil
+}
+
+// RemoveService 删除一个 service, 不存在时返回 ErrUnknownService
+// 正在执行的请求不再等待 handler 返回, 客户端立即收到 ErrServerDead
+// 之后发往该 service 的请求也以 ErrServerDead 失败, 直到重新注册同名的 service
+func (rs *Server) RemoveService(name string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if _, ok := rs.services[name]; !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownService, name)
+	}
+	close(rs.removed[name])
+	delete(rs.services, name)
+	delete(rs.removed, name)
+	rs.dropped[name] = true
+	return nil
+}
+
+// ReplaceService 用 svc 替换同名的 service, 不存在时直接注册
+// 发往旧 service 的请求与 RemoveService 一样以 ErrServerDead 失败, 之后的请求由 svc 处理
+func (rs *Server) ReplaceService(svc *Service) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if removed, ok := rs.removed[svc.name]; ok {
+		close(removed)
+	}
+	rs.services[svc.name] = svc
+	rs.removed[svc.name] = make(chan struct{})
+	delete(rs.dropped, svc.name)
+}
+
+// Use 注册 interceptor, 先注册的在外层
+func (rs *Server) Use(interceptors ...Interceptor) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	// 复制一份, 正在执行的请求使用的切片不受影响
+	rs.interceptors = append(append([]Interceptor{}, rs.interceptors...), interceptors...)
+}
+
+// RecoverPanics 为 true 时捕获 handler 的 panic 而不是让整个进程崩溃
+// 发生 panic 的请求以 ErrPanicked 失败, 之后 server 就像崩溃了一样, 所有请求以 ErrServerDead 失败,
+// 需要用一个新的 Server 重新 AddServer() 来模拟重启
+func (rs *Server) RecoverPanics(yes bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.recoverPanics = yes
+}
+
+// 返回捕获到的 panic
+func (rs *Server) Panics() []PanicRecord {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return append([]PanicRecord{}, rs.panics...)
+}
+
+// handler panic 之后 server 是否已经崩溃
+func (rs *Server) Crashed() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.crashed
 }
 
 func (rs *Server) GetCount() int {
@@ -312,16 +1082,51 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 
 	rs.count += 1
 
+	if rs.crashed {
+		rs.mu.Unlock()
+		return replyMsg{err: ErrServerDead}
+	}
+
 	// 将 Raft.AppendEntries 分离 到 服务和 方法中
 	dot := strings.LastIndex(req.svcMeth, ".")
-	serviceName := req.svcMeth[:dot]
-	methodName := req.svcMeth[dot+1:]
+	serviceName := req.svcMeth
+	methodName := ""
+	if dot >= 0 {
+		serviceName = req.svcMeth[:dot]
+		methodName = req.svcMeth[dot+1:]
+	}
 
 	service, ok := rs.services[serviceName]
-	rs.mu.Unlock()
-
 	if ok {
-		return service.dispatch(methodName, req)
+		removed := rs.removed[serviceName]
+		interceptors := rs.interceptors
+		recoverPanics := rs.recoverPanics
+		rs.mu.Unlock()
+
+		// handler 在另一个 goroutine 中执行, service 被删除时不再等待它
+		ch := make(chan replyMsg, 1)
+		go func() {
+			if recoverPanics {
+				defer func() {
+					if r := recover(); r != nil {
+						ch <- rs.crash(req, r)
+					}
+				}()
+			}
+			ch <- service.dispatch(methodName, req, interceptors)
+		}()
+		select {
+		case r := <-ch:
+			return r
+		case <-removed:
+			return replyMsg{err: executed(ErrServerDead)}
+		}
+	}
+
+	if rs.dropped[serviceName] {
+		// 与 server 崩溃一样, 而不是调用了不存在的 service
+		rs.mu.Unlock()
+		return replyMsg{err: fmt.Errorf("%w: service %v was removed", ErrServerDead, serviceName)}
 	}
 
 	//没有找到相对应的service
@@ -329,10 +1134,59 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 	for k, _ := range rs.services {
 		choices = append(choices, k)
 	}
-	log.Fatalf("labrpc.Server.dispatch(): unknown service %v in %v.%v; expecting one of %v\n",
-		serviceName, serviceName, methodName, choices)
-	return replyMsg{false, nil}
+	rs.mu.Unlock()
 
+	err := fmt.Errorf("%w %v in %v; expecting one of %v", ErrUnknownService, serviceName, req.svcMeth, choices)
+	return replyMsg{err: err}
+}
+
+// CallInfo 描述服务端收到的一次请求
+// handler 可以把 *CallInfo 作为第一个参数, 以此知道请求来自哪个客户端
+type CallInfo struct {
+	ServiceMethod string      // e.g. "Raft.AppendEntries"
+	Service       string      // e.g. "Raft"
+	Method        string      // e.g. "AppendEntries"
+	EndName       interface{} // 发送请求的客户端的名字
+	ServerName    interface{} // 处理请求的 server 的名字
+	RequestID     uint64      // Network 为每个请求分配的编号, 从 1 开始递增
+	Sent          time.Time   // 客户端发送请求的时间, 由 Network 的 Clock 给出
+	Header        Metadata    // 客户端通过 WithHeader() 发送的元数据, 不会是 nil
+	Trailer       Metadata    // handler 与 interceptor 写入的元数据随回复返回客户端, 不会是 nil
+}
+
+// Handler 执行一次请求, args 是解码后的参数, reply 是指向返回值的指针
+// 返回的 error 会作为 ServerError 传回客户端
+type Handler func(info *CallInfo, args interface{}, reply interface{}) error
+
+// Interceptor 包装 handler 的执行
+// 可以在调用 next 之前或之后检查、修改 args 与 reply (reply 在 Interceptor 返回后才被 gob 编码),
+// 也可以不调用 next 直接返回, 以此拦截请求或注入错误
+type Interceptor func(info *CallInfo, args interface{}, reply interface{}, next Handler) error
+
+// 把 interceptors 与 handler 组合成一个 Handler, interceptors[0] 在最外层
+func chain(interceptors []Interceptor, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(info *CallInfo, args interface{}, reply interface{}) error {
+			return interceptor(info, args, reply, next)
+		}
+	}
+	return handler
+}
+
+// 记录 handler 的 panic, 并把 server 标记为崩溃
+func (rs *Server) crash(req reqMsg, r interface{}) replyMsg {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.panics = append(rs.panics, PanicRecord{
+		ServiceMethod: req.svcMeth,
+		EndName:       req.endname,
+		Value:         r,
+		Stack:         debug.Stack(),
+	})
+	rs.crashed = true
+	return replyMsg{err: fmt.Errorf("%w in %v: %v", ErrPanicked, req.svcMeth, r)}
 }
 
 // 用于反射整个service
@@ -343,32 +1197,130 @@ type Service struct {
 	methods map[string]reflect.Method // 函数类型
 }
 
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfCallInfo = reflect.TypeOf((*CallInfo)(nil))
+
 // MakeService 通过反射获取传入的 rcvr的字段、方法
+// 签名不符合 handler 要求的方法会被忽略, 需要知道原因时使用 MakeServiceStrict
 func MakeService(rcvr interface{}) *Service {
+	svc, _ := makeService("", rcvr, false)
+	return svc
+}
+
+// 同 MakeService, 但是使用 name 作为 service 的名字而不是 rcvr 的类型名
+// 这样同一个类型的多个实例可以注册到同一个 Server 上, 类型改名也不会影响调用方
+func MakeNamedService(name string, rcvr interface{}) *Service {
+	svc, _ := makeService(name, rcvr, false)
+	return svc
+}
+
+// 同 MakeService, 但是所有没有注册的导出方法都会在返回的 *RegistrationError 中列出
+// 此时还会检查参数与返回值的类型能否被 gob 编码
+func MakeServiceStrict(rcvr interface{}) (*Service, error) {
+	return makeService("", rcvr, true)
+}
+
+// 返回 service 的名字, 即 "Raft.AppendEntries" 中的 "Raft"
+func (svc *Service) Name() string {
+	return svc.name
+}
+
+// 没有被注册为 handler 的方法与原因
+type RejectedMethod struct {
+	Name   string
+	Reason string
+}
+
+// MakeServiceStrict 返回的错误
+type RegistrationError struct {
+	Service  string
+	Rejected []RejectedMethod
+}
+
+func (e *RegistrationError) Error() string {
+	reasons := []string{}
+	for _, m := range e.Rejected {
+		reasons = append(reasons, m.Name+": "+m.Reason)
+	}
+	return fmt.Sprintf("labrpc: service %v: %v method(s) not registered: %v",
+		e.Service, len(e.Rejected), strings.Join(reasons, "; "))
+}
+
+// name 为空时使用 rcvr 的类型名
+func makeService(name string, rcvr interface{}, strict bool) (*Service, error) {
 	svc := &Service{}
 	svc.typ = reflect.TypeOf(rcvr)                      // reflect.Type
 	svc.rcvr = reflect.ValueOf(rcvr)                    // reflect.Value
 	svc.name = reflect.Indirect(svc.rcvr).Type().Name() // 返回svc.rcvr持有的指向的值 的Value的类型名
+	if name != "" {
+		svc.name = name
+	}
 	svc.methods = map[string]reflect.Method{}
 
+	rejected := []RejectedMethod{}
 	for m := 0; m < svc.typ.NumMethod(); m++ { // NumMethod() 返回该类型的方法的数目
 		method := svc.typ.Method(m) // 返回第m 个方法
-		mtype := method.Type        // 方法类型
 		mname := method.Name        // 方法名
 
-		// PlgPath 类型的包路径 NumIn 返回func类型的参数个数 In(i)返回func类型的第i个参数的类型(Type) NumOut() 返回func类型的返回值个数
-		if method.PkgPath != "" || mtype.NumIn() != 3 || mtype.In(2).Kind() != reflect.Ptr || mtype.NumOut() != 0 {
+		if err := checkMethod(method, strict); err != nil {
 			// bad method  not for a handler
+			rejected = append(rejected, RejectedMethod{mname, err.Error()})
 		} else {
 			svc.methods[mname] = method
 		}
 	}
 
-	return svc
+	if strict && len(rejected) > 0 {
+		return svc, &RegistrationError{svc.name, rejected}
+	}
+	return svc, nil
+}
+
+// 检查方法能否作为 handler, strict 时还检查参数与返回值的类型能否被 gob 编码
+func checkMethod(method reflect.Method, strict bool) error {
+	mtype := method.Type // 方法类型
+
+	// PlgPath 类型的包路径 NumIn 返回func类型的参数个数 In(i)返回func类型的第i个参数的类型(Type) NumOut() 返回func类型的返回值个数
+	// handler 可以没有返回值, 或者像 net/rpc 一样返回一个 error
+	if method.PkgPath != "" {
+		return errors.New("method is not exported")
+	}
+	// 可选的第一个参数 *CallInfo
+	a := 1
+	if mtype.NumIn() == 4 && mtype.In(1) == typeOfCallInfo {
+		a = 2
+	}
+	if mtype.NumIn() != a+2 {
+		return fmt.Errorf("wrong number of arguments %v, expecting (args, *reply) or (*CallInfo, args, *reply)", mtype.NumIn()-1)
+	}
+	if mtype.In(a+1).Kind() != reflect.Ptr {
+		return fmt.Errorf("reply type %v is not a pointer", mtype.In(a+1))
+	}
+	if !(mtype.NumOut() == 0 || mtype.NumOut() == 1 && mtype.Out(0) == typeOfError) {
+		return fmt.Errorf("has return values %v, expecting none or error", mtype)
+	}
+
+	if strict {
+		if err := gobCheck(mtype.In(a)); err != nil {
+			return fmt.Errorf("args type %v: %v", mtype.In(a), err)
+		}
+		if err := gobCheck(mtype.In(a + 1).Elem()); err != nil {
+			return fmt.Errorf("reply type %v: %v", mtype.In(a+1), err)
+		}
+	}
+	return nil
+}
+
+// 用零值试编码一次, 检查该类型能否被 gob 编码
+func gobCheck(t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return gob.NewEncoder(io.Discard).EncodeValue(reflect.New(t))
 }
 
 // dispatch 通过反射执行Call("method", arg, &reply) 传入的方法
-func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
+func (svc *Service) dispatch(methname string, req reqMsg, interceptors []Interceptor) replyMsg {
 	if method, ok := svc.methods[methname]; ok {
 		// 读取参数
 		// type 是一个 req.argsType的指针
@@ -379,21 +1331,63 @@ func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 		decoder := gob.NewDecoder(buff)
 		decoder.Decode(args.Interface())
 
-		//为reply申请内存空间
-		replyType := method.Type.In(2)   // 返回该method 的第2个参数的类型 Type
-		replyType = replyType.Elem()     // 返回该Type的具体元素类型
-		replyv := reflect.New(replyType) // 返回Value类型值，该值持有指向replyType的新申请的指针
+		// handler 的第一个参数可以是 *CallInfo
+		withInfo := method.Type.NumIn() == 4
 
-		// 执行函数
-		function := method.Func
-		function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv}) // Call([]Value) 反射执行函数
+		//为reply申请内存空间
+		replyType := method.Type.In(method.Type.NumIn() - 1) // 返回该method 的最后一个参数的类型 Type
+		replyType = replyType.Elem()                         // 返回该Type的具体元素类型
+		replyv := reflect.New(replyType)                     // 返回Value类型值，该值持有指向replyType的新申请的指针
+
+		// 执行函数, 经过 Server.Use() 注册的 interceptor
+		info := &CallInfo{
+			ServiceMethod: req.svcMeth,
+			Service:       svc.name,
+			Method:        methname,
+			EndName:       req.endname,
+			ServerName:    req.servername,
+			RequestID:     req.id,
+			Sent:          req.sent,
+			Header:        req.header,
+			Trailer:       Metadata{},
+		}
+		if info.Header == nil {
+			info.Header = Metadata{}
+		}
+		handler := func(info *CallInfo, args interface{}, reply interface{}) error {
+			// interceptor 可能替换了参数, 类型不对时 reflect 会 panic
+			argsType := method.Type.In(method.Type.NumIn() - 2)
+			if t := reflect.TypeOf(args); t == nil || !t.AssignableTo(argsType) {
+				return fmt.Errorf("%w: args of %v is %v, expecting %v", ErrArgType, req.svcMeth, t, argsType)
+			}
+			if t := reflect.TypeOf(reply); t == nil || !t.AssignableTo(replyv.Type()) {
+				return fmt.Errorf("%w: reply of %v is %v, expecting %v", ErrArgType, req.svcMeth, t, replyv.Type())
+			}
+			function := method.Func
+			in := []reflect.Value{svc.rcvr, reflect.ValueOf(args), reflect.ValueOf(reply)}
+			if withInfo {
+				in = []reflect.Value{svc.rcvr, reflect.ValueOf(info), reflect.ValueOf(args), reflect.ValueOf(reply)}
+			}
+			out := function.Call(in) // Call([]Value) 反射执行函数
+			if len(out) == 1 && !out[0].IsNil() {
+				return out[0].Interface().(error)
+			}
+			return nil
+		}
+		if err := chain(interceptors, handler)(info, args.Elem().Interface(), replyv.Interface()); errors.Is(err, ErrArgType) {
+			// handler 没有执行
+			return replyMsg{err: err, trailer: info.Trailer}
+		} else if err != nil {
+			// handler 返回了错误, 只把错误信息传回客户端
+			return replyMsg{ok: true, err: ServerError(err.Error()), trailer: info.Trailer}
+		}
 
 		// 对reply进行反序列
 		buf := new(bytes.Buffer)
 		encoder := gob.NewEncoder(buf)
 		encoder.EncodeValue(replyv)
 
-		return replyMsg{true, buf.Bytes()}
+		return replyMsg{ok: true, reply: buf.Bytes(), trailer: info.Trailer}
 	}
 
 	//没有找到相对应的方法
@@ -401,7 +1395,6 @@ func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 	for k, _ := range svc.methods {
 		choices = append(choices, k)
 	}
-	log.Fatalf("labrpc.Service.dispatch(): unknown method %v in %v; expecting one of %v\n",
-		methname, req.svcMeth, choices)
-	return replyMsg{false, nil}
+	err := fmt.Errorf("%w %v in %v; expecting one of %v", ErrUnknownMethod, methname, req.svcMeth, choices)
+	return replyMsg{err: err}
 }
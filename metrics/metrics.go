@@ -0,0 +1,198 @@
+// metrics 把 labrpc.Network 的统计数据导出到 expvar 与 Prometheus 文本格式,
+// 用于在长时间运行的模拟中实时观察网络
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	labrpc "github.com/shockcoder/rpc-realize"
+)
+
+// Handler 以 Prometheus 文本格式输出 rn 的统计数据
+func Handler(rn *labrpc.Network) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w, rn.Stats())
+	})
+}
+
+// PublishExpvar 把 rn 的统计数据以 name 发布到 expvar, 每次读取时生成快照
+// 与 expvar.Publish 一样, name 重复时 panic
+func PublishExpvar(name string, rn *labrpc.Network) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return expvarSnapshot(rn.Stats())
+	}))
+}
+
+// expvar 以 JSON 输出, server/end name 不一定是字符串, 统一转换成字符串
+func expvarSnapshot(s labrpc.Stats) map[string]interface{} {
+	methods := map[string]interface{}{}
+	for name, ms := range s.Methods {
+		methods[name] = map[string]interface{}{
+			"count":         ms.Count,
+			"req_bytes":     ms.ReqBytes,
+			"reply_bytes":   ms.ReplyBytes,
+			"successes":     ms.Successes,
+			"drops":         ms.Drops,
+			"server_dead":   ms.ServerDead,
+			"failures":      ms.Failures,
+			"abandoned":     ms.Abandoned,
+			"in_flight":     ms.InFlight,
+			"duplicates":    ms.Duplicates,
+			"requests_lost": ms.RequestsLost,
+			"replies_lost":  ms.RepliesLost,
+			"total_mean":    ms.Total.Mean().Seconds(),
+		}
+	}
+	servers := map[string]labrpc.Traffic{}
+	for name, t := range s.Servers {
+		servers[fmt.Sprint(name)] = t
+	}
+	ends := map[string]labrpc.Traffic{}
+	for name, t := range s.Ends {
+		ends[fmt.Sprint(name)] = t
+	}
+	return map[string]interface{}{
+		"total":     s.Total,
+		"in_flight": s.InFlight,
+		"methods":   methods,
+		"servers":   servers,
+		"ends":      ends,
+	}
+}
+
+// WriteText 以 Prometheus 文本格式写出 s
+func WriteText(w io.Writer, s labrpc.Stats) error {
+	b := bufio.NewWriter(w)
+
+	methods := []string{}
+	for name := range s.Methods {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+
+	header(b, "labrpc_in_flight", "gauge", "RPCs being processed by the network.")
+	fmt.Fprintf(b, "labrpc_in_flight %d\n", s.InFlight)
+
+	header(b, "labrpc_requests_total", "counter", "RPCs sent, by method.")
+	for _, m := range methods {
+		fmt.Fprintf(b, "labrpc_requests_total{method=%s} %d\n", quote(m), s.Methods[m].Count)
+	}
+
+	header(b, "labrpc_results_total", "counter", "RPC outcomes, by method.")
+	for _, m := range methods {
+		ms := s.Methods[m]
+		for _, r := range []struct {
+			name string
+			n    int64
+		}{
+			{"success", ms.Successes},
+			{"drop", ms.Drops},
+			{"server_dead", ms.ServerDead},
+			{"failure", ms.Failures},
+			{"abandoned", ms.Abandoned},
+		} {
+			fmt.Fprintf(b, "labrpc_results_total{method=%s,result=%s} %d\n", quote(m), quote(r.name), r.n)
+		}
+	}
+
+	header(b, "labrpc_lost_total", "counter", "Dropped RPCs, by method and whether the request or the reply was lost.")
+	for _, m := range methods {
+		ms := s.Methods[m]
+		fmt.Fprintf(b, "labrpc_lost_total{method=%s,stage=\"request\"} %d\n", quote(m), ms.RequestsLost)
+		fmt.Fprintf(b, "labrpc_lost_total{method=%s,stage=\"reply\"} %d\n", quote(m), ms.RepliesLost)
+	}
+
+	header(b, "labrpc_duplicates_total", "counter", "Requests delivered to a server more than once, by method.")
+	for _, m := range methods {
+		fmt.Fprintf(b, "labrpc_duplicates_total{method=%s} %d\n", quote(m), s.Methods[m].Duplicates)
+	}
+
+	header(b, "labrpc_method_in_flight", "gauge", "RPCs being processed by the network, by method.")
+	for _, m := range methods {
+		fmt.Fprintf(b, "labrpc_method_in_flight{method=%s} %d\n", quote(m), s.Methods[m].InFlight)
+	}
+
+	header(b, "labrpc_method_bytes_total", "counter", "Gob-encoded bytes, by method and direction.")
+	for _, m := range methods {
+		ms := s.Methods[m]
+		fmt.Fprintf(b, "labrpc_method_bytes_total{method=%s,direction=\"request\"} %d\n", quote(m), ms.ReqBytes)
+		fmt.Fprintf(b, "labrpc_method_bytes_total{method=%s,direction=\"reply\"} %d\n", quote(m), ms.ReplyBytes)
+	}
+
+	servers := sortedKeys(s.Servers)
+	header(b, "labrpc_server_requests_total", "counter", "RPCs sent, by server.")
+	for _, name := range servers {
+		fmt.Fprintf(b, "labrpc_server_requests_total{server=%s} %d\n", quote(name), s.Servers[name].Count)
+	}
+	header(b, "labrpc_server_bytes_total", "counter", "Gob-encoded bytes, by server and direction.")
+	for _, name := range servers {
+		t := s.Servers[name]
+		fmt.Fprintf(b, "labrpc_server_bytes_total{server=%s,direction=\"request\"} %d\n", quote(name), t.ReqBytes)
+		fmt.Fprintf(b, "labrpc_server_bytes_total{server=%s,direction=\"reply\"} %d\n", quote(name), t.ReplyBytes)
+	}
+
+	histograms := []struct {
+		name string
+		help string
+		get  func(ms labrpc.MethodStats) labrpc.Histogram
+	}{
+		{"labrpc_network_delay_seconds", "Simulated network delay of RPCs that reached a handler.",
+			func(ms labrpc.MethodStats) labrpc.Histogram { return ms.NetworkDelay }},
+		{"labrpc_handler_seconds", "Handler execution time.",
+			func(ms labrpc.MethodStats) labrpc.Histogram { return ms.HandlerTime }},
+		{"labrpc_total_seconds", "Time from the network receiving an RPC to replying.",
+			func(ms labrpc.MethodStats) labrpc.Histogram { return ms.Total }},
+	}
+	for _, h := range histograms {
+		header(b, h.name, "histogram", h.help)
+		for _, m := range methods {
+			histogram(b, h.name, m, h.get(s.Methods[m]))
+		}
+	}
+
+	return b.Flush()
+}
+
+func header(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Prometheus 的直方图是累积的, 桶的上界以秒为单位
+func histogram(w io.Writer, name string, method string, h labrpc.Histogram) {
+	var n int64
+	for i, bound := range labrpc.HistogramBounds {
+		if i < len(h.Buckets) {
+			n += h.Buckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{method=%s,le=\"%g\"} %d\n", name, quote(method), bound.Seconds(), n)
+	}
+	fmt.Fprintf(w, "%s_bucket{method=%s,le=\"+Inf\"} %d\n", name, quote(method), h.Count)
+	fmt.Fprintf(w, "%s_sum{method=%s} %g\n", name, quote(method), h.Sum.Seconds())
+	fmt.Fprintf(w, "%s_count{method=%s} %d\n", name, quote(method), h.Count)
+}
+
+// server name 可以是任意类型, 按字符串形式排序并作为 label 的值
+func sortedKeys(m map[interface{}]labrpc.Traffic) []interface{} {
+	keys := []interface{}{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	return keys
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Prometheus label 的值
+func quote(v interface{}) string {
+	return `"` + escaper.Replace(fmt.Sprint(v)) + `"`
+}
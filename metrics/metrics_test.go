@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	labrpc "github.com/shockcoder/rpc-realize"
+)
+
+type EchoServer struct{}
+
+func (es *EchoServer) Echo(args string, reply *string) {
+	*reply = args
+}
+
+func makeNetwork(t *testing.T) *labrpc.Network {
+	rn := labrpc.MakeNetWork()
+
+	rs := labrpc.MakeServer()
+	rs.AddService(labrpc.MakeService(&EchoServer{}))
+	rn.AddServer("server\"1", rs)
+
+	e := rn.MakeEnd("end1")
+	rn.Connect("end1", "server\"1")
+	rn.Enable("end1", true)
+
+	for i := 0; i < 3; i++ {
+		reply := ""
+		if e.Call("EchoServer.Echo", "hello", &reply) == false || reply != "hello" {
+			t.Fatalf("wrong reply %v from Echo", reply)
+		}
+	}
+	return rn
+}
+
+func TestHandler(t *testing.T) {
+	rn := makeNetwork(t)
+
+	srv := httptest.NewServer(Handler(rn))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	text := string(body)
+
+	for _, want := range []string{
+		"# TYPE labrpc_requests_total counter\n",
+		`labrpc_requests_total{method="EchoServer.Echo"} 3` + "\n",
+		`labrpc_results_total{method="EchoServer.Echo",result="success"} 3` + "\n",
+		`labrpc_server_requests_total{server="server\"1"} 3` + "\n",
+		`labrpc_total_seconds_bucket{method="EchoServer.Echo",le="+Inf"} 3` + "\n",
+		`labrpc_total_seconds_count{method="EchoServer.Echo"} 3` + "\n",
+		"labrpc_in_flight 0\n",
+	} {
+		if strings.Contains(text, want) == false {
+			t.Fatalf("missing %q in:\n%v", want, text)
+		}
+	}
+	if ct := resp.Header.Get("Content-Type"); strings.HasPrefix(ct, "text/plain") == false {
+		t.Fatalf("wrong Content-Type %v", ct)
+	}
+}
+
+// expvar 的名字是进程全局的, go test -count=N 时每次使用不同的名字
+var published int64
+
+func TestPublishExpvar(t *testing.T) {
+	rn := makeNetwork(t)
+	name := fmt.Sprintf("%v-%d", t.Name(), atomic.AddInt64(&published, 1))
+	PublishExpvar(name, rn)
+
+	var v struct {
+		Total   labrpc.Traffic
+		Methods map[string]map[string]float64
+		Servers map[string]labrpc.Traffic
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &v); err != nil {
+		t.Fatalf("bad expvar JSON: %v", err)
+	}
+	if v.Total.Count != 3 || v.Methods["EchoServer.Echo"]["successes"] != 3 || v.Servers["server\"1"].Count != 3 {
+		t.Fatalf("wrong expvar snapshot %+v", v)
+	}
+}
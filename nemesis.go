@@ -0,0 +1,440 @@
+package labrpc
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 故障的种类
+type FaultKind int
+
+const (
+	FaultPartition FaultKind = iota // 按 Groups 划分网络
+	FaultHeal                       // 撤销分区, 恢复 FaultSlow 修改过的 server 链路特征
+	FaultKill                       // 从网络中删除 Server
+	FaultRestart                    // 把 OnRestart() 创建的新 Server 加入网络
+	FaultSlow                       // 发往 Server 的请求使用 Profile
+	FaultSkew                       // Server 的时钟偏移 Skew
+)
+
+var faultNames = map[FaultKind]string{
+	FaultPartition: "partition",
+	FaultHeal:      "heal",
+	FaultKill:      "kill",
+	FaultRestart:   "restart",
+	FaultSlow:      "slow",
+	FaultSkew:      "skew",
+}
+
+func (k FaultKind) String() string {
+	if name, ok := faultNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("FaultKind(%d)", int(k))
+}
+
+// Fault 描述一次故障, 只使用与 Kind 相关的字段
+type Fault struct {
+	Kind    FaultKind
+	Groups  [][]interface{} // FaultPartition
+	Server  interface{}     // FaultKill, FaultRestart, FaultSlow, FaultSkew
+	Profile LinkProfile     // FaultSlow
+	Skew    time.Duration   // FaultSkew
+}
+
+func (f Fault) String() string {
+	switch f.Kind {
+	case FaultPartition:
+		return fmt.Sprintf("partition %v", f.Groups)
+	case FaultHeal:
+		return "heal"
+	case FaultSlow:
+		return fmt.Sprintf("slow %v %+v", f.Server, f.Profile)
+	case FaultSkew:
+		return fmt.Sprintf("skew %v %v", f.Server, f.Skew)
+	default:
+		return fmt.Sprintf("%v %v", f.Kind, f.Server)
+	}
+}
+
+// 在 Nemesis 启动 At 之后执行 Fault
+type Step struct {
+	At    time.Duration
+	Fault Fault
+}
+
+// Nemesis 的故障计划, Next() 依次返回 At 递增的 Step, 没有更多 Step 时返回 false
+// Next() 只在 Nemesis 的 goroutine 中调用
+type Schedule interface {
+	Next() (Step, bool)
+}
+
+// 固定的故障计划
+func Script(steps ...Step) Schedule {
+	s := &script{steps: append([]Step(nil), steps...)}
+	sort.SliceStable(s.steps, func(i, j int) bool {
+		return s.steps[i].At < s.steps[j].At
+	})
+	return s
+}
+
+type script struct {
+	steps []Step
+}
+
+func (s *script) Next() (Step, bool) {
+	if len(s.steps) == 0 {
+		return Step{}, false
+	}
+	step := s.steps[0]
+	s.steps = s.steps[1:]
+	return step, true
+}
+
+// 按 Nemesis.Log() 的记录重放同样的故障
+func Replay(events []Event) Schedule {
+	steps := []Step{}
+	for _, ev := range events {
+		steps = append(steps, Step{At: ev.At, Fault: ev.Fault})
+	}
+	return Script(steps...)
+}
+
+// 参与随机故障的节点: 一个 server 以及它用来访问其它 server 的 end
+// 分区时 end 与所属的 server 在同一个分组
+type Node struct {
+	Server interface{}
+	Ends   []interface{}
+}
+
+// 随机故障计划的参数
+type RandomConfig struct {
+	Nodes    []Node
+	Weights  map[FaultKind]int // 各种故障的权重, 没有出现的故障不会发生
+	Interval time.Duration     // 相邻 Step 的间隔在 [Interval/2, Interval*3/2) 之间
+	Steps    int               // Step 的数量, 0 表示不限
+	Slow     LinkProfile       // FaultSlow 使用的链路特征, 零值时使用 defaultSlow
+	MaxSkew  time.Duration     // FaultSkew 的偏移在 [-MaxSkew, MaxSkew] 之间
+}
+
+var defaultSlow = LinkProfile{Latency: 100 * time.Millisecond, Jitter: 100 * time.Millisecond}
+
+// 按权重随机生成的故障计划, 相同的 r 的种子得到相同的计划
+// 只会 kill 还在网络中的 server, 只会 restart 被它 kill 的 server
+func Random(r *rand.Rand, cfg RandomConfig) Schedule {
+	return &randomSchedule{cfg: cfg, rand: r, killed: map[interface{}]bool{}}
+}
+
+type randomSchedule struct {
+	cfg    RandomConfig
+	rand   *rand.Rand
+	at     time.Duration
+	n      int
+	killed map[interface{}]bool
+}
+
+func (s *randomSchedule) Next() (Step, bool) {
+	if s.cfg.Steps > 0 && s.n >= s.cfg.Steps {
+		return Step{}, false
+	}
+
+	// 按 FaultKind 的顺序累加权重, 保证同样的种子得到同样的结果
+	kinds := []FaultKind{}
+	total := 0
+	for k := FaultPartition; k <= FaultSkew; k++ {
+		if w := s.cfg.Weights[k]; w > 0 && s.possible(k) {
+			kinds = append(kinds, k)
+			total += w
+		}
+	}
+	if total == 0 {
+		return Step{}, false
+	}
+	x := s.rand.Intn(total)
+	kind := kinds[0]
+	for _, k := range kinds {
+		if x < s.cfg.Weights[k] {
+			kind = k
+			break
+		}
+		x -= s.cfg.Weights[k]
+	}
+
+	s.n++
+	if s.cfg.Interval > 0 {
+		s.at += s.cfg.Interval/2 + time.Duration(s.rand.Int63n(int64(s.cfg.Interval)))
+	}
+	return Step{At: s.at, Fault: s.fault(kind)}, true
+}
+
+func (s *randomSchedule) possible(k FaultKind) bool {
+	switch k {
+	case FaultPartition:
+		return len(s.cfg.Nodes) >= 2
+	case FaultKill:
+		return len(s.killed) < len(s.cfg.Nodes)
+	case FaultRestart:
+		return len(s.killed) > 0
+	case FaultHeal:
+		return true
+	default:
+		return len(s.cfg.Nodes) > 0
+	}
+}
+
+func (s *randomSchedule) fault(k FaultKind) Fault {
+	nodes := s.cfg.Nodes
+	f := Fault{Kind: k}
+	switch k {
+	case FaultPartition:
+		// 打乱节点后分成两组, 每组至少一个节点
+		perm := s.rand.Perm(len(nodes))
+		cut := 1 + s.rand.Intn(len(nodes)-1)
+		f.Groups = [][]interface{}{{}, {}}
+		for i, p := range perm {
+			g := 0
+			if i >= cut {
+				g = 1
+			}
+			f.Groups[g] = append(f.Groups[g], nodes[p].Server)
+			f.Groups[g] = append(f.Groups[g], nodes[p].Ends...)
+		}
+	case FaultKill:
+		alive := []interface{}{}
+		for _, n := range nodes {
+			if !s.killed[n.Server] {
+				alive = append(alive, n.Server)
+			}
+		}
+		f.Server = alive[s.rand.Intn(len(alive))]
+		s.killed[f.Server] = true
+	case FaultRestart:
+		dead := []interface{}{}
+		for _, n := range nodes {
+			if s.killed[n.Server] {
+				dead = append(dead, n.Server)
+			}
+		}
+		f.Server = dead[s.rand.Intn(len(dead))]
+		delete(s.killed, f.Server)
+	case FaultSlow:
+		f.Server = nodes[s.rand.Intn(len(nodes))].Server
+		f.Profile = s.cfg.Slow
+		if f.Profile == (LinkProfile{}) {
+			f.Profile = defaultSlow
+		}
+	case FaultSkew:
+		f.Server = nodes[s.rand.Intn(len(nodes))].Server
+		if s.cfg.MaxSkew > 0 {
+			f.Skew = time.Duration(s.rand.Int63n(2*int64(s.cfg.MaxSkew)+1)) - s.cfg.MaxSkew
+		}
+	}
+	return f
+}
+
+// 一条执行过的故障记录
+type Event struct {
+	Time  time.Time     // 执行时 Network 的时钟
+	At    time.Duration // 相对 Nemesis 启动的时间
+	Fault Fault
+}
+
+func (ev Event) String() string {
+	return fmt.Sprintf("%v +%v %v", ev.Time.Format("15:04:05.000"), ev.At, ev.Fault)
+}
+
+// Nemesis 按照 Schedule 在 Network 上制造故障, 时间由 Network 的 Clock 给出
+type Nemesis struct {
+	rn       *Network
+	schedule Schedule
+
+	mu      sync.Mutex
+	started bool
+	start   time.Time
+	log     []Event
+	killed  map[interface{}]bool
+	slowed  map[interface{}]savedProfile // FaultSlow 之前 server 的链路特征, FaultHeal 时恢复
+	restart func(servername interface{}) *Server
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func MakeNemesis(rn *Network, schedule Schedule) *Nemesis {
+	return &Nemesis{
+		rn:       rn,
+		schedule: schedule,
+		killed:   map[interface{}]bool{},
+		slowed:   map[interface{}]savedProfile{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+type savedProfile struct {
+	profile LinkProfile
+	ok      bool // 是否设置过, 没有设置过时 FaultHeal 删除 FaultSlow 的设置
+}
+
+// 设置 FaultRestart 时创建新 Server 的函数, 应该从 rn.Persister()/rn.Storage() 恢复状态
+// 被删除的 Server 仍然持有崩溃之前的存储, 不能重新使用, 因此没有设置该函数时 FaultRestart 被忽略
+// 函数执行时不持有 Nemesis 的锁, 可以调用 Log() 或 Apply()
+func (nm *Nemesis) OnRestart(f func(servername interface{}) *Server) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	nm.restart = f
+}
+
+// 开始执行故障计划
+func (nm *Nemesis) Start() {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if nm.started {
+		return
+	}
+	nm.started = true
+	nm.start = nm.rn.clock.Now()
+	go nm.run()
+}
+
+// 停止执行故障计划并等待正在执行的 Step 完成
+// 已经造成的故障不会撤销, 需要时 Apply(Fault{Kind: FaultHeal})
+func (nm *Nemesis) Stop() {
+	nm.stopOnce.Do(func() {
+		close(nm.stop)
+		nm.mu.Lock()
+		defer nm.mu.Unlock()
+		if !nm.started {
+			nm.started = true
+			close(nm.done)
+		}
+	})
+	<-nm.done
+}
+
+// 故障计划执行完毕或者 Stop() 之后关闭
+func (nm *Nemesis) Done() <-chan struct{} {
+	return nm.done
+}
+
+// 执行过的故障记录
+func (nm *Nemesis) Log() []Event {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	return append([]Event(nil), nm.log...)
+}
+
+func (nm *Nemesis) run() {
+	defer close(nm.done)
+
+	for {
+		step, ok := nm.schedule.Next()
+		if !ok {
+			return
+		}
+		nm.mu.Lock()
+		wait := step.At - nm.rn.clock.Now().Sub(nm.start)
+		nm.mu.Unlock()
+		if wait > 0 {
+			t := nm.rn.clock.NewTimer(wait)
+			select {
+			case <-t.C():
+			case <-nm.stop:
+				t.Stop()
+				return
+			}
+		}
+		select {
+		case <-nm.stop:
+			return
+		default:
+		}
+		nm.Apply(step.Fault)
+	}
+}
+
+// 立即执行一个故障并记录下来, 可以在 Start() 之前或与计划一起使用
+// 无效的故障 (kill 不在网络中的 server, restart 没有被 kill 的 server 或者没有 OnRestart()) 被忽略, 返回 false
+func (nm *Nemesis) Apply(f Fault) bool {
+	var restarted *Server
+	if f.Kind == FaultRestart {
+		nm.mu.Lock()
+		killed := nm.killed[f.Server]
+		restart := nm.restart
+		nm.mu.Unlock()
+		if !killed {
+			return false
+		}
+		if restart == nil {
+			log.Printf("labrpc.Nemesis: ignoring restart %v without OnRestart()\n", f.Server)
+			return false
+		}
+		restarted = restart(f.Server)
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	rn := nm.rn
+	switch f.Kind {
+	case FaultPartition:
+		rn.Partition(f.Groups...)
+	case FaultHeal:
+		rn.Heal()
+		// 只撤销 FaultSlow 的设置, 保留用户配置的链路特征
+		rn.mu.Lock()
+		for servername, saved := range nm.slowed {
+			if saved.ok {
+				rn.serverProfiles[servername] = saved.profile
+			} else {
+				delete(rn.serverProfiles, servername)
+			}
+		}
+		rn.mu.Unlock()
+		nm.slowed = map[interface{}]savedProfile{}
+	case FaultKill:
+		rn.mu.Lock()
+		rs := rn.servers[f.Server]
+		rn.mu.Unlock()
+		if rs == nil {
+			return false
+		}
+		nm.killed[f.Server] = true
+		rn.DeleteServer(f.Server)
+	case FaultRestart:
+		// 回调执行期间可能已经被另一个 FaultRestart 重启
+		if !nm.killed[f.Server] {
+			return false
+		}
+		delete(nm.killed, f.Server)
+		rn.AddServer(f.Server, restarted)
+	case FaultSlow:
+		rn.mu.Lock()
+		if _, ok := nm.slowed[f.Server]; !ok {
+			p, ok := rn.serverProfiles[f.Server]
+			nm.slowed[f.Server] = savedProfile{profile: p, ok: ok}
+		}
+		rn.serverProfiles[f.Server] = f.Profile
+		rn.mu.Unlock()
+	case FaultSkew:
+		rn.SetClockSkew(f.Server, f.Skew)
+	default:
+		return false
+	}
+
+	now := rn.clock.Now()
+	at := time.Duration(0)
+	if nm.started {
+		at = now.Sub(nm.start)
+	}
+	nm.log = append(nm.log, Event{Time: now, At: at, Fault: f})
+	return true
+}
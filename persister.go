@@ -0,0 +1,143 @@
+package labrpc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// 对使用其它 Storage 的 server 调用 Network.Persister(), 以此 panic
+var ErrStorageType = errors.New("labrpc: server does not use a Persister")
+
+// Storage 是 Persister 与 FilePersister 共同的接口
+type Storage interface {
+	SaveRaftState(state []byte)
+	ReadRaftState() []byte
+	RaftStateSize() int
+	SaveStateAndSnapshot(state []byte, snapshot []byte)
+	ReadSnapshot() []byte
+	SnapshotSize() int
+
+	// 模拟崩溃, 返回重启后的 server 看到的存储
+	// 之后对原来的对象的写入不会影响返回的存储
+	Crash() Storage
+}
+
+// Persister 保存 Raft 的状态与快照, 用于模拟 server 的崩溃与重启
+// 与 Network 配合使用: 通过 rn.Persister(servername) 获取, DeleteServer 之后
+// 网络换上一个 Crash() 的结果, 被删除的 server 之后的写入不会影响重启的 server
+type Persister struct {
+	mu        sync.Mutex
+	raftstate []byte
+	snapshot  []byte
+}
+
+func MakePersister() *Persister {
+	return &Persister{}
+}
+
+func clone(orig []byte) []byte {
+	x := make([]byte, len(orig))
+	copy(x, orig)
+	return x
+}
+
+// 复制一份状态, 之后两者的写入互不影响
+func (ps *Persister) Copy() *Persister {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	np := MakePersister()
+	np.raftstate = ps.raftstate
+	np.snapshot = ps.snapshot
+	return np
+}
+
+func (ps *Persister) SaveRaftState(state []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.raftstate = clone(state)
+}
+
+func (ps *Persister) ReadRaftState() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return clone(ps.raftstate)
+}
+
+func (ps *Persister) RaftStateSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return len(ps.raftstate)
+}
+
+// 内存中的状态在崩溃时不会丢失, 等价于 Copy()
+func (ps *Persister) Crash() Storage {
+	return ps.Copy()
+}
+
+// 原子地保存 Raft 的状态与快照
+func (ps *Persister) SaveStateAndSnapshot(state []byte, snapshot []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.raftstate = clone(state)
+	ps.snapshot = clone(snapshot)
+}
+
+func (ps *Persister) ReadSnapshot() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return clone(ps.snapshot)
+}
+
+func (ps *Persister) SnapshotSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return len(ps.snapshot)
+}
+
+// 返回 servername 当前的 Persister, 第一次调用时创建
+// 重启 server 时应该在 AddServer 之前重新获取
+// 通过 SetStorage 指定了其它存储时以 ErrStorageType panic, 应该使用 Storage()
+func (rn *Network) Persister(servername interface{}) *Persister {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	s, ok := rn.persisters[servername]
+	if !ok {
+		s = MakePersister()
+		rn.persisters[servername] = s
+	}
+	ps, ok := s.(*Persister)
+	if !ok {
+		panic(fmt.Errorf("labrpc.Network.Persister(): %w: %v uses a %T, call Storage() instead", ErrStorageType, servername, s))
+	}
+	return ps
+}
+
+// 为 servername 指定存储, 例如 FilePersister
+func (rn *Network) SetStorage(servername interface{}, s Storage) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.persisters[servername] = s
+}
+
+// 返回 servername 当前的存储, 没有指定时与 Persister() 一样创建一个 Persister
+func (rn *Network) Storage(servername interface{}) Storage {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	s, ok := rn.persisters[servername]
+	if !ok {
+		s = MakePersister()
+		rn.persisters[servername] = s
+	}
+	return s
+}
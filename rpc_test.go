@@ -1,9 +1,15 @@
 package labrpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -56,6 +62,26 @@ func (js *JunkServer) Handler5(args JunkArgs, reply *JunkReply) {
 	reply.X = "no pointer"
 }
 
+// returns an error like a net/rpc handler
+func (js *JunkServer) Handler6(args int, reply *int) error {
+	if args < 0 {
+		return errors.New("negative args")
+	}
+	*reply = args * 2
+	return nil
+}
+
+// takes the caller's identity as the first argument
+func (js *JunkServer) Handler7(info *CallInfo, args int, reply *string) {
+	*reply = fmt.Sprintf("%v-%v-%v-%v", info.EndName, info.ServerName, info.RequestID, args)
+}
+
+// echoes request metadata in the trailer
+func (js *JunkServer) Handler8(info *CallInfo, args int, reply *int) {
+	info.Trailer["client"] = info.Header["client"]
+	*reply = args
+}
+
 func TestBasic(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
@@ -297,7 +323,7 @@ func TestUnreliable(t *testing.T) {
 	}
 
 	if total == nclients || total == 0 {
-		t.Fatalf("all RPCs succeeded despite unreliable")
+		t.Fatalf("all RPCs succeeded despite unreliable (seed %v)", rn.Seed())
 	}
 }
 
@@ -502,3 +528,1478 @@ func TestBenchmark(t *testing.T) {
 	}
 	fmt.Printf("%v for %v\n", time.Since(t0), n)
 }
+
+// rn.Partition() 切断跨分组的请求, rn.Heal() 恢复
+func TestPartition(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	for _, name := range []string{"s1", "s2"} {
+		rs := MakeServer()
+		rs.AddService(svc)
+		rn.AddServer(name, rs)
+	}
+
+	e11 := rn.MakeEnd("e1-s1")
+	e12 := rn.MakeEnd("e1-s2")
+	e21 := rn.MakeEnd("e2-s1")
+	rn.Connect("e1-s1", "s1")
+	rn.Connect("e1-s2", "s2")
+	rn.Connect("e2-s1", "s1")
+	for _, name := range []string{"e1-s1", "e1-s2", "e2-s1"} {
+		rn.Enable(name, true)
+	}
+
+	rn.Partition([]interface{}{"s1", "e1-s1", "e1-s2"}, []interface{}{"s2", "e2-s1"})
+
+	reply := ""
+	if e11.Call("JunkServer.Handler2", 1, &reply) == false {
+		t.Fatalf("RPC within a group failed")
+	}
+	if e12.Call("JunkServer.Handler2", 2, &reply) == true {
+		t.Fatalf("RPC crossing the partition succeeded")
+	}
+	if e21.Call("JunkServer.Handler2", 3, &reply) == true {
+		t.Fatalf("RPC crossing the partition succeeded")
+	}
+
+	// 单向分区只影响一个方向
+	rn.Heal()
+	rn.PartitionOneWay([]interface{}{"e2-s1"}, []interface{}{"s1"})
+	if e11.Call("JunkServer.Handler2", 4, &reply) == false {
+		t.Fatalf("RPC failed despite one-way partition in the other direction")
+	}
+	if e21.Call("JunkServer.Handler2", 5, &reply) == true {
+		t.Fatalf("RPC succeeded despite one-way partition")
+	}
+
+	rn.Heal()
+	if e12.Call("JunkServer.Handler2", 6, &reply) == false {
+		t.Fatalf("RPC failed after Heal()")
+	}
+}
+
+// per end/server/link 的 LinkProfile 只影响对应的链路
+func TestLinkProfile(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	for _, name := range []string{"s1", "s2"} {
+		rs := MakeServer()
+		rs.AddService(svc)
+		rn.AddServer(name, rs)
+	}
+
+	e11 := rn.MakeEnd("e1-s1")
+	e12 := rn.MakeEnd("e1-s2")
+	e21 := rn.MakeEnd("e2-s1")
+	rn.Connect("e1-s1", "s1")
+	rn.Connect("e1-s2", "s2")
+	rn.Connect("e2-s1", "s1")
+	for _, name := range []string{"e1-s1", "e1-s2", "e2-s1"} {
+		rn.Enable(name, true)
+	}
+
+	lossy := LinkProfile{RequestLoss: 1}
+	rn.SetServerProfile("s1", lossy)
+	rn.SetLinkProfile("e1-s1", "s1", LinkProfile{Latency: 10 * time.Millisecond})
+
+	reply := ""
+	t0 := time.Now()
+	if e11.Call("JunkServer.Handler2", 1, &reply) == false {
+		t.Fatalf("RPC failed despite link profile overriding server profile")
+	}
+	if time.Since(t0) < 10*time.Millisecond {
+		t.Fatalf("RPC returned before link latency elapsed")
+	}
+	if e21.Call("JunkServer.Handler2", 2, &reply) == true {
+		t.Fatalf("RPC succeeded despite lossy server profile")
+	}
+	if e12.Call("JunkServer.Handler2", 3, &reply) == false {
+		t.Fatalf("RPC to another server affected by server profile")
+	}
+
+	rn.ClearProfiles()
+	rn.SetEndProfile("e1-s2", LinkProfile{ReplyLoss: 1})
+	if e21.Call("JunkServer.Handler2", 4, &reply) == false {
+		t.Fatalf("RPC failed after ClearProfiles()")
+	}
+	if e12.Call("JunkServer.Handler2", 5, &reply) == true {
+		t.Fatalf("RPC succeeded despite lossy end profile")
+	}
+}
+
+// 相同的种子与相同的请求顺序得到相同的故障决策
+func TestSeed(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	run := func(seed int64) []bool {
+		rn := MakeNetWork(WithSeed(seed))
+		rn.SetProfile(LinkProfile{RequestLoss: 0.3, ReplyLoss: 0.3})
+
+		js := &JunkServer{}
+		rs := MakeServer()
+		rs.AddService(MakeService(js))
+		rn.AddServer("server99", rs)
+
+		e := rn.MakeEnd("end1-99")
+		rn.Connect("end1-99", "server99")
+		rn.Enable("end1-99", true)
+
+		results := []bool{}
+		for i := 0; i < 50; i++ {
+			reply := ""
+			results = append(results, e.Call("JunkServer.Handler2", i, &reply))
+		}
+		return results
+	}
+
+	r1 := run(42)
+	r2 := run(42)
+	for i := range r1 {
+		if r1[i] != r2[i] {
+			t.Fatalf("RPC %v had different outcomes with the same seed", i)
+		}
+	}
+}
+
+// 使用 SimClock 时, 网络延迟不消耗真实时间
+func TestSimClock(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	clock := NewSimClock(time.Unix(0, 0))
+	defer clock.Stop()
+
+	rn := MakeNetWork(WithClock(clock))
+	rn.SetProfile(LinkProfile{Latency: 5 * time.Second})
+	rn.LongDelays(true)
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	t0 := time.Now()
+	s0 := rn.Clock().Now()
+	for i := 0; i < 10; i++ {
+		reply := ""
+		e.Call("JunkServer.Handler2", i, &reply)
+		if reply != "handler2-"+strconv.Itoa(i) {
+			t.Fatalf("wrong reply %v from Handler2", reply)
+		}
+	}
+	if d := rn.Clock().Now().Sub(s0); d < 50*time.Second {
+		t.Fatalf("simulated time advanced only %v, expected at least 50s", d)
+	}
+
+	// 断开的客户端在 LongDelays 下最多等待 7 秒的模拟时间
+	rn.Enable("end1-99", false)
+	reply := ""
+	if e.Call("JunkServer.Handler2", 99, &reply) {
+		t.Fatalf("RPC succeeded on disabled end")
+	}
+
+	if d := time.Since(t0); d > 5*time.Second {
+		t.Fatalf("RPCs took %v of real time with SimClock", d)
+	}
+}
+
+// 处理完的 RPC 不会留下等待者让 SimClock 推进时间, Stop() 的定时器不会再被唤醒
+func TestSimClockTimer(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	// 不自动推进, 结果不受 handler 执行快慢的影响
+	clock := NewSimClock(time.Unix(0, 0))
+	clock.Stop()
+
+	rn := MakeNetWork(WithClock(clock))
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	for i := 0; i < 20; i++ {
+		reply := ""
+		e.Call("JunkServer.Handler2", i, &reply)
+		if reply != "handler2-"+strconv.Itoa(i) {
+			t.Fatalf("wrong reply %v from Handler2", reply)
+		}
+	}
+	clock.mu.Lock()
+	n := len(clock.waiters)
+	clock.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("zero-latency RPCs left %v waiters on the clock", n)
+	}
+
+	tm := clock.NewTimer(time.Second)
+	if tm.Stop() == false {
+		t.Fatalf("Stop() of a pending timer returned false")
+	}
+	if tm.Stop() {
+		t.Fatalf("second Stop() returned true")
+	}
+	clock.Advance(2 * time.Second)
+	select {
+	case <-tm.C():
+		t.Fatalf("stopped timer fired")
+	default:
+	}
+}
+
+// CallContext 在 ctx 超时后立即返回, 网络中处理该请求的 goroutine 也随之退出
+func TestCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	{
+		reply := ""
+		err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply)
+		if err != nil || reply != "handler2-111" {
+			t.Fatalf("wrong reply %v (%v) from Handler2", reply, err)
+		}
+	}
+
+	rn.SetProfile(LinkProfile{Latency: 10 * time.Second})
+	ngoroutine := runtime.NumGoroutine()
+
+	t0 := time.Now()
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		reply := ""
+		err := e.CallContext(ctx, "JunkServer.Handler2", i, &reply)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) == false {
+			t.Fatalf("expected DeadlineExceeded, got %v", err)
+		}
+	}
+	if d := time.Since(t0); d > 2*time.Second {
+		t.Fatalf("CallContext took %v despite deadline", d)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > ngoroutine {
+		t.Fatalf("%v goroutines leaked after cancelled calls", n-ngoroutine)
+	}
+}
+
+// 使用 ClientEnd.Go() 并发地发送 RPC
+func TestGo(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	nrpcs := 20
+	done := make(chan *Call, nrpcs)
+	replies := make([]string, nrpcs)
+	for i := 0; i < nrpcs; i++ {
+		e.Go("JunkServer.Handler2", i, &replies[i], done)
+	}
+
+	for i := 0; i < nrpcs; i++ {
+		call := <-done
+		if call.Error != nil {
+			t.Fatalf("async RPC failed: %v", call.Error)
+		}
+		arg := call.Args.(int)
+		wanted := "handler2-" + strconv.Itoa(arg)
+		if *call.Reply.(*string) != wanted {
+			t.Fatalf("wrong reply %v from Handler2, expecting %v", *call.Reply.(*string), wanted)
+		}
+		if call.Finished.Before(call.Sent) {
+			t.Fatalf("Call finished before it was sent")
+		}
+	}
+
+	// done 为 nil 时使用 Call 自带的 channel
+	reply := ""
+	call := <-e.Go("JunkServer.Handler2", 111, &reply, nil).Done
+	if call.Error != nil || reply != "handler2-111" {
+		t.Fatalf("wrong reply %v (%v) from Handler2", reply, call.Error)
+	}
+}
+
+// CallErr 返回的错误区分失败的原因
+func TestCallErr(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	reply := ""
+
+	rn.Enable("end1-99", true)
+	if err := e.CallErr("JunkServer.Handler2", 1, &reply); errors.Is(err, ErrNoServer) == false {
+		t.Fatalf("expected ErrNoServer, got %v", err)
+	}
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", false)
+	if err := e.CallErr("JunkServer.Handler2", 2, &reply); errors.Is(err, ErrDisabled) == false {
+		t.Fatalf("expected ErrDisabled, got %v", err)
+	}
+
+	rn.Enable("end1-99", true)
+	rn.Partition([]interface{}{"end1-99"}, []interface{}{"server99"})
+	if err := e.CallErr("JunkServer.Handler2", 3, &reply); errors.Is(err, ErrPartitioned) == false {
+		t.Fatalf("expected ErrPartitioned, got %v", err)
+	}
+
+	rn.Heal()
+	rn.SetProfile(LinkProfile{RequestLoss: 1})
+	if err := e.CallErr("JunkServer.Handler2", 4, &reply); errors.Is(err, ErrDropped) == false {
+		t.Fatalf("expected ErrDropped, got %v", err)
+	}
+
+	rn.SetProfile(LinkProfile{})
+	rn.SetFailurePolicy(FailReply)
+	var wrong JunkReply
+	if err := e.CallErr("JunkServer.Handler2", 5, &wrong); errors.Is(err, ErrDecode) == false {
+		t.Fatalf("expected ErrDecode, got %v", err)
+	}
+
+	if err := e.CallErr("JunkServer.Handler2", 6, &reply); err != nil || reply != "handler2-6" {
+		t.Fatalf("wrong reply %v (%v) from Handler2", reply, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		reply := 0
+		done <- e.CallErr("JunkServer.Handler3", 99, &reply)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	rn.DeleteServer("server99")
+	if err := <-done; errors.Is(err, ErrServerDead) == false {
+		t.Fatalf("expected ErrServerDead, got %v", err)
+	}
+}
+
+// FailReply / FailPanic 下调用不存在的 service/method 不会结束进程
+func TestFailurePolicy(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	rn.SetFailurePolicy(FailReply)
+	reply := ""
+	if err := e.CallErr("Junk.Handler2", 1, &reply); errors.Is(err, ErrUnknownService) == false {
+		t.Fatalf("expected ErrUnknownService, got %v", err)
+	}
+	if err := e.CallErr("JunkServer.NoSuchHandler", 1, &reply); errors.Is(err, ErrUnknownMethod) == false {
+		t.Fatalf("expected ErrUnknownMethod, got %v", err)
+	}
+	if e.Call("JunkServer.NoSuchHandler", 1, &reply) {
+		t.Fatalf("Call to unknown method succeeded")
+	}
+
+	rn.SetFailurePolicy(FailPanic)
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			if errors.Is(err, ErrUnknownMethod) == false {
+				t.Fatalf("expected panic with ErrUnknownMethod, got %v", err)
+			}
+		}()
+		e.Call("JunkServer.NoSuchHandler", 1, &reply)
+	}()
+
+	// 异步调用的错误写入 Call.Error, 不会在网络的 goroutine 中 panic
+	call := <-e.Go("JunkServer.NoSuchHandler", 1, &reply, nil).Done
+	if errors.Is(call.Error, ErrUnknownMethod) == false {
+		t.Fatalf("expected ErrUnknownMethod from Go, got %v", call.Error)
+	}
+}
+
+// handler 返回的 error 传回给客户端
+func TestHandlerError(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	reply := 0
+	if err := e.CallErr("JunkServer.Handler6", 21, &reply); err != nil || reply != 42 {
+		t.Fatalf("wrong reply %v (%v) from Handler6", reply, err)
+	}
+
+	reply = 0
+	err := e.CallErr("JunkServer.Handler6", -1, &reply)
+	if errors.Is(err, ErrHandler) == false || err.Error() != "negative args" {
+		t.Fatalf("expected handler error, got %v", err)
+	}
+	var serr ServerError
+	if errors.As(err, &serr) == false || reply != 0 {
+		t.Fatalf("expected ServerError and no reply, got %v %v", err, reply)
+	}
+	if e.Call("JunkServer.Handler6", -1, &reply) {
+		t.Fatalf("Call succeeded despite handler error")
+	}
+}
+
+type BadServer struct{}
+
+func (bs *BadServer) Good(args int, reply *int)                   {}
+func (bs *BadServer) NoReply(args int)                            {}
+func (bs *BadServer) ValueReply(args int, reply int)              {}
+func (bs *BadServer) Returns(args int, reply *int) int            { return 0 }
+func (bs *BadServer) ChanArgs(args chan int, reply *int)          {}
+func (bs *BadServer) Unexported(args struct{ x int }, reply *int) {}
+
+// MakeServiceStrict 列出所有没有注册的方法
+func TestMakeServiceStrict(t *testing.T) {
+	svc, err := MakeServiceStrict(&JunkServer{})
+	if err != nil || svc == nil {
+		t.Fatalf("MakeServiceStrict(JunkServer) failed: %v", err)
+	}
+
+	_, err = MakeServiceStrict(&BadServer{})
+	var rerr *RegistrationError
+	if errors.As(err, &rerr) == false {
+		t.Fatalf("expected RegistrationError, got %v", err)
+	}
+	rejected := map[string]bool{}
+	for _, m := range rerr.Rejected {
+		rejected[m.Name] = true
+	}
+	for _, name := range []string{"NoReply", "ValueReply", "Returns", "ChanArgs", "Unexported"} {
+		if rejected[name] == false {
+			t.Fatalf("%v was not rejected: %v", name, err)
+		}
+	}
+	if rejected["Good"] || len(rerr.Rejected) != 5 {
+		t.Fatalf("wrong rejected methods: %v", err)
+	}
+
+	// 非 strict 模式下与之前一样忽略这些方法
+	svc = MakeService(&BadServer{})
+	if len(svc.methods) != 3 {
+		t.Fatalf("MakeService registered %v methods, expected 3", len(svc.methods))
+	}
+}
+
+// 同一个类型的两个实例以不同的名字注册到同一个 Server
+func TestNamedService(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js1 := &JunkServer{}
+	js2 := &JunkServer{}
+	rs := MakeServer()
+	if err := rs.AddService(MakeNamedService("Junk1", js1)); err != nil {
+		t.Fatalf("AddService(Junk1) failed: %v", err)
+	}
+	if err := rs.AddService(MakeNamedService("Junk2", js2)); err != nil {
+		t.Fatalf("AddService(Junk2) failed: %v", err)
+	}
+	err := rs.AddService(MakeNamedService("Junk1", &JunkServer{}))
+	if errors.Is(err, ErrDuplicateService) == false {
+		t.Fatalf("expected ErrDuplicateService, got %v", err)
+	}
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	reply := ""
+	e.Call("Junk1.Handler2", 1, &reply)
+	e.Call("Junk2.Handler2", 2, &reply)
+	e.Call("Junk2.Handler2", 3, &reply)
+
+	js1.mu.Lock()
+	defer js1.mu.Unlock()
+	js2.mu.Lock()
+	defer js2.mu.Unlock()
+	if len(js1.log2) != 1 || len(js2.log2) != 2 {
+		t.Fatalf("wrong number of RPCs delivered: %v %v", js1.log2, js2.log2)
+	}
+}
+
+// RemoveService / ReplaceService 使正在执行的请求立即失败
+func TestRemoveService(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	done := make(chan error)
+	go func() {
+		reply := 0
+		done <- e.CallErr("JunkServer.Handler3", 99, &reply)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	js2 := &JunkServer{}
+	rs.ReplaceService(MakeService(js2))
+	select {
+	case err := <-done:
+		if errors.Is(err, ErrServerDead) == false {
+			t.Fatalf("expected ErrServerDead, got %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Handler3 should fail after ReplaceService()")
+	}
+
+	reply := ""
+	if e.Call("JunkServer.Handler2", 1, &reply) == false {
+		t.Fatalf("RPC to replaced service failed")
+	}
+	js2.mu.Lock()
+	if len(js2.log2) != 1 {
+		t.Fatalf("RPC was not delivered to the new service")
+	}
+	js2.mu.Unlock()
+
+	if err := rs.RemoveService("JunkServer"); err != nil {
+		t.Fatalf("RemoveService failed: %v", err)
+	}
+	if err := rs.RemoveService("JunkServer"); errors.Is(err, ErrUnknownService) == false {
+		t.Fatalf("expected ErrUnknownService, got %v", err)
+	}
+	// 默认的 FailFatal 下调用被删除的 service 不会结束进程
+	if err := e.CallErr("JunkServer.Handler2", 2, &reply); errors.Is(err, ErrServerDead) == false {
+		t.Fatalf("expected ErrServerDead after RemoveService(), got %v", err)
+	}
+
+	// 重新注册模拟组件重启
+	if err := rs.AddService(MakeService(&JunkServer{})); err != nil {
+		t.Fatalf("AddService after RemoveService failed: %v", err)
+	}
+	if e.Call("JunkServer.Handler2", 3, &reply) == false || reply != "handler2-3" {
+		t.Fatalf("RPC to re-added service failed")
+	}
+}
+
+// Server.Use() 注册的 interceptor 可以观察、拦截请求并修改回复
+func TestInterceptor(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	var mu sync.Mutex
+	seen := []string{}
+	rs.Use(func(info *CallInfo, args interface{}, reply interface{}, next Handler) error {
+		mu.Lock()
+		seen = append(seen, fmt.Sprintf("%v %v %v", info.EndName, info.ServiceMethod, args))
+		mu.Unlock()
+		return next(info, args, reply)
+	}, func(info *CallInfo, args interface{}, reply interface{}, next Handler) error {
+		if info.Method == "Handler1" {
+			return errors.New("Handler1 is blocked")
+		}
+		err := next(info, args, reply)
+		*reply.(*string) += "-intercepted"
+		return err
+	})
+
+	reply := ""
+	if err := e.CallErr("JunkServer.Handler2", 7, &reply); err != nil || reply != "handler2-7-intercepted" {
+		t.Fatalf("wrong reply %v (%v) from Handler2", reply, err)
+	}
+
+	n := 0
+	if err := e.CallErr("JunkServer.Handler1", "9", &n); errors.Is(err, ErrHandler) == false {
+		t.Fatalf("expected Handler1 to be blocked, got %v", err)
+	}
+	js.mu.Lock()
+	if len(js.log1) != 0 {
+		t.Fatalf("Handler1 ran despite interceptor")
+	}
+	js.mu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || seen[0] != "end1-99 JunkServer.Handler2 7" {
+		t.Fatalf("interceptor saw %v", seen)
+	}
+}
+
+// interceptor 传给 handler 的参数类型不对时返回 ErrArgType, 而不是 panic
+func TestInterceptorArgType(t *testing.T) {
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	rs.Use(func(info *CallInfo, args interface{}, reply interface{}, next Handler) error {
+		if info.Method == "Handler1" {
+			return next(info, 9, reply)
+		}
+		return next(info, args, nil)
+	})
+
+	n := 0
+	if err := e.CallErr("JunkServer.Handler1", "9", &n); errors.Is(err, ErrArgType) == false {
+		t.Fatalf("expected ErrArgType for args, got %v", err)
+	}
+	reply := ""
+	if err := e.CallErr("JunkServer.Handler2", 7, &reply); errors.Is(err, ErrArgType) == false {
+		t.Fatalf("expected ErrArgType for reply, got %v", err)
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.log1) != 0 || len(js.log2) != 0 {
+		t.Fatalf("handlers ran with wrong argument types")
+	}
+}
+
+// 客户端 interceptor: Network 的在外层, 可以用来重试
+func TestClientInterceptor(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork(WithSeed(1))
+	rn.SetProfile(LinkProfile{RequestLoss: 0.5})
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	var mu sync.Mutex
+	trace := []string{}
+	rn.UseClient(func(ctx context.Context, e *ClientEnd, call *Call, invoke Invoker) error {
+		mu.Lock()
+		trace = append(trace, "retry")
+		mu.Unlock()
+		for {
+			err := invoke(ctx, call)
+			if errors.Is(err, ErrDropped) == false {
+				return err
+			}
+		}
+	})
+	attempts := 0
+	e.Use(func(ctx context.Context, e *ClientEnd, call *Call, invoke Invoker) error {
+		mu.Lock()
+		trace = append(trace, fmt.Sprintf("%v %v", e.Name(), call.ServiceMethod))
+		attempts++
+		mu.Unlock()
+		return invoke(ctx, call)
+	})
+
+	for i := 0; i < 10; i++ {
+		reply := ""
+		if err := e.CallErr("JunkServer.Handler2", i, &reply); err != nil || reply != "handler2-"+strconv.Itoa(i) {
+			t.Fatalf("wrong reply %v (%v) from Handler2 despite retries", reply, err)
+		}
+	}
+	call := <-e.Go("JunkServer.Handler2", 10, new(string), nil).Done
+	if call.Error != nil {
+		t.Fatalf("async RPC failed despite retries: %v", call.Error)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if trace[0] != "retry" || trace[1] != "end1-99 JunkServer.Handler2" {
+		t.Fatalf("interceptors ran in the wrong order: %v", trace)
+	}
+	if attempts <= 11 {
+		t.Fatalf("expected some RPCs to be retried, got %v attempts", attempts)
+	}
+}
+
+// handler 通过 *CallInfo 知道请求来自哪个客户端
+func TestCallInfo(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e1 := rn.MakeEnd("end1-99")
+	e2 := rn.MakeEnd("end2-99")
+	rn.Connect("end1-99", "server99")
+	rn.Connect("end2-99", "server99")
+	rn.Enable("end1-99", true)
+	rn.Enable("end2-99", true)
+
+	reply := ""
+	e1.Call("JunkServer.Handler7", 1, &reply)
+	if reply != "end1-99-server99-1-1" {
+		t.Fatalf("wrong reply %v from Handler7", reply)
+	}
+	e2.Call("JunkServer.Handler7", 2, &reply)
+	if reply != "end2-99-server99-2-2" {
+		t.Fatalf("wrong reply %v from Handler7", reply)
+	}
+}
+
+// 元数据随请求到达 handler, trailer 随回复返回客户端
+func TestMetadata(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	// 客户端 interceptor 为每个请求加上 trace ID, 服务端 interceptor 把它写回 trailer
+	e.Use(func(ctx context.Context, e *ClientEnd, call *Call, invoke Invoker) error {
+		WithHeader(Metadata{"trace": "t1"})(call)
+		return invoke(ctx, call)
+	})
+	var kept *CallInfo
+	rs.Use(func(info *CallInfo, args interface{}, reply interface{}, next Handler) error {
+		info.Trailer["trace"] = info.Header["trace"]
+		kept = info
+		return next(info, args, reply)
+	})
+
+	header := Metadata{"client": "c1"}
+	var trailer Metadata
+	reply := 0
+	err := e.CallErr("JunkServer.Handler8", 5, &reply, WithHeader(header), WithTrailer(&trailer))
+	if err != nil || reply != 5 {
+		t.Fatalf("wrong reply %v (%v) from Handler8", reply, err)
+	}
+	if trailer["client"] != "c1" || trailer["trace"] != "t1" {
+		t.Fatalf("wrong trailer %v", trailer)
+	}
+	if len(header) != 1 {
+		t.Fatalf("caller's header was modified: %v", header)
+	}
+
+	// 服务端之后对 trailer 的修改不会影响客户端的副本
+	kept.Trailer["trace"] = "late"
+	if trailer["trace"] != "t1" {
+		t.Fatalf("server modified caller's trailer: %v", trailer)
+	}
+
+	call := <-e.Go("JunkServer.Handler8", 6, &reply, nil, WithHeader(Metadata{"client": "c2"})).Done
+	if call.Error != nil || call.Trailer["client"] != "c2" {
+		t.Fatalf("wrong trailer %v (%v) from async call", call.Trailer, call.Error)
+	}
+}
+
+type PanicServer struct{}
+
+func (ps *PanicServer) Panic(args int, reply *int) {
+	panic(fmt.Sprintf("bad args %v", args))
+}
+
+// RecoverPanics(true) 时 handler 的 panic 不会结束进程, server 之后像崩溃了一样
+func TestRecoverPanics(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&PanicServer{}))
+	rs.AddService(MakeService(&JunkServer{}))
+	rs.RecoverPanics(true)
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	reply := 0
+	if err := e.CallErr("PanicServer.Panic", 3, &reply); errors.Is(err, ErrPanicked) == false {
+		t.Fatalf("expected ErrPanicked, got %v", err)
+	}
+	panics := rs.Panics()
+	if len(panics) != 1 || panics[0].Value != "bad args 3" || panics[0].ServiceMethod != "PanicServer.Panic" ||
+		len(panics[0].Stack) == 0 {
+		t.Fatalf("wrong panic records %v", panics)
+	}
+
+	if rs.Crashed() == false {
+		t.Fatalf("server should have crashed")
+	}
+	s := ""
+	if err := e.CallErr("JunkServer.Handler2", 1, &s); errors.Is(err, ErrServerDead) == false {
+		t.Fatalf("expected ErrServerDead after panic, got %v", err)
+	}
+
+	// 用新的 server 模拟重启
+	rs2 := MakeServer()
+	rs2.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs2)
+	if err := e.CallErr("JunkServer.Handler2", 2, &s); err != nil || s != "handler2-2" {
+		t.Fatalf("wrong reply %v (%v) from restarted server", s, err)
+	}
+}
+
+// test net.GetTotalBytes() 与按 server/end/method 的流量统计
+func TestBytes(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer(99, rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", 99)
+	rn.Enable("end1-99", true)
+
+	for i := 0; i < 17; i++ {
+		args := strings.Repeat("x", 128)
+		reply := 0
+		e.Call("JunkServer.Handler1", args, &reply)
+	}
+	reply := ""
+	e.Call("JunkServer.Handler2", 1, &reply)
+
+	n := rn.GetTotalBytes()
+	if n < 17*128 || n > 17*(128+100)+100 {
+		t.Fatalf("wrong GetTotalBytes() %v, expected about %v", n, 17*128)
+	}
+	if c := rn.GetTotalCount(); c != 18 {
+		t.Fatalf("wrong GetTotalCount() %v, expected 18", c)
+	}
+
+	h1 := rn.GetMethodTraffic("JunkServer.Handler1")
+	h2 := rn.GetMethodTraffic("JunkServer.Handler2")
+	if h1.Count != 17 || h2.Count != 1 || h1.ReqBytes < 17*128 || h2.ReplyBytes == 0 {
+		t.Fatalf("wrong per-method traffic %+v %+v", h1, h2)
+	}
+	if st, et := rn.GetServerTraffic(99), rn.GetEndTraffic("end1-99"); st.Bytes() != n || et.Bytes() != n {
+		t.Fatalf("wrong per-server/end traffic %+v %+v, expected %v bytes", st, et, n)
+	}
+}
+
+// net.Stats() 按方法统计调用结果与耗时
+func TestStats(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	clock := NewSimClock(time.Unix(0, 0))
+	defer clock.Stop()
+
+	rn := MakeNetWork(WithClock(clock))
+	rn.SetProfile(LinkProfile{Latency: 30 * time.Millisecond})
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	reply := ""
+	for i := 0; i < 5; i++ {
+		e.Call("JunkServer.Handler2", i, &reply)
+	}
+	rn.SetProfile(LinkProfile{RequestLoss: 1})
+	for i := 0; i < 3; i++ {
+		e.Call("JunkServer.Handler2", i, &reply)
+	}
+	rn.SetProfile(LinkProfile{})
+	rn.Enable("end1-99", false)
+	e.Call("JunkServer.Handler2", 0, &reply)
+
+	ms := rn.Stats().Methods["JunkServer.Handler2"]
+	if ms.Count != 9 || ms.Successes != 5 || ms.Drops != 4 || ms.ServerDead != 0 {
+		t.Fatalf("wrong method stats %+v", ms)
+	}
+	if ms.Total.Count != 9 || ms.NetworkDelay.Count != 5 || ms.HandlerTime.Count != 5 {
+		t.Fatalf("wrong histogram counts %v %v %v", ms.Total.Count, ms.NetworkDelay.Count, ms.HandlerTime.Count)
+	}
+	if d := ms.NetworkDelay.Quantile(0.5); d != 50*time.Millisecond {
+		t.Fatalf("wrong median network delay %v, expected bucket 50ms", d)
+	}
+	if d := ms.NetworkDelay.Mean(); d < 30*time.Millisecond {
+		t.Fatalf("wrong mean network delay %v", d)
+	}
+}
+
+// DuplicateRate 让 server 多次执行同一个请求, 客户端只收到一个回复
+func TestDuplicate(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+	rn.SetProfile(LinkProfile{DuplicateRate: 1})
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	for i := 0; i < 5; i++ {
+		reply := ""
+		if e.Call("JunkServer.Handler2", i, &reply) == false || reply != "handler2-"+strconv.Itoa(i) {
+			t.Fatalf("wrong reply %v from Handler2", reply)
+		}
+	}
+
+	// 重复的请求是异步执行的
+	t0 := time.Now()
+	for time.Since(t0) < 2*time.Second {
+		js.mu.Lock()
+		n := len(js.log2)
+		js.mu.Unlock()
+		if n >= 10 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := rs.GetCount(); n != 10 {
+		t.Fatalf("server executed %v requests, expected 10", n)
+	}
+	seen := map[int]int{}
+	js.mu.Lock()
+	for _, x := range js.log2 {
+		seen[x]++
+	}
+	js.mu.Unlock()
+	for i := 0; i < 5; i++ {
+		if seen[i] != 2 {
+			t.Fatalf("request %v executed %v times, expected 2", i, seen[i])
+		}
+	}
+
+	ms := rn.Stats().Methods["JunkServer.Handler2"]
+	if ms.Count != 5 || ms.Successes != 5 || ms.Duplicates != 5 {
+		t.Fatalf("wrong method stats %+v", ms)
+	}
+}
+
+// 请求丢失与回复丢失可以分别设置, 并能区分 handler 是否执行过
+func TestRequestReplyLoss(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	reply := ""
+	rn.SetRequestLoss(1)
+	for i := 0; i < 3; i++ {
+		err := e.CallErr("JunkServer.Handler2", i, &reply)
+		if errors.Is(err, ErrRequestLost) == false || errors.Is(err, ErrDropped) == false {
+			t.Fatalf("expected ErrRequestLost, got %v", err)
+		}
+	}
+	if n := rs.GetCount(); n != 0 {
+		t.Fatalf("server executed %v lost requests", n)
+	}
+
+	rn.SetRequestLoss(0)
+	rn.SetReplyLoss(1)
+	for i := 0; i < 2; i++ {
+		err := e.CallErr("JunkServer.Handler2", i, &reply)
+		if errors.Is(err, ErrReplyLost) == false || errors.Is(err, ErrDropped) == false {
+			t.Fatalf("expected ErrReplyLost, got %v", err)
+		}
+	}
+	if n := rs.GetCount(); n != 2 {
+		t.Fatalf("server executed %v requests, expected 2", n)
+	}
+
+	ms := rn.Stats().Methods["JunkServer.Handler2"]
+	if ms.Drops != 5 || ms.RequestsLost != 3 || ms.RepliesLost != 2 {
+		t.Fatalf("wrong method stats %+v", ms)
+	}
+}
+
+// Nemesis 按计划制造故障, 记录下来并可以重放
+func TestNemesis(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	clock := NewSimClock(time.Unix(0, 0))
+	defer clock.Stop()
+
+	rn := MakeNetWork(WithClock(clock))
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	nm := MakeNemesis(rn, Script(
+		Step{At: 3 * time.Second, Fault: Fault{Kind: FaultHeal}},
+		Step{At: 1 * time.Second, Fault: Fault{Kind: FaultKill, Server: "server99"}},
+		Step{At: 2 * time.Second, Fault: Fault{Kind: FaultRestart, Server: "server99"}},
+		Step{At: 2 * time.Second, Fault: Fault{Kind: FaultSkew, Server: "server99", Skew: time.Hour}},
+		Step{At: 2 * time.Second, Fault: Fault{Kind: FaultPartition, Groups: [][]interface{}{{"end1-99"}, {"server99"}}}},
+	))
+	// 重启时创建新的 Server, 回调中可以使用 Nemesis
+	var restarted *Server
+	restart := func(nm *Nemesis) func(servername interface{}) *Server {
+		return func(servername interface{}) *Server {
+			if len(nm.Log()) != 1 {
+				t.Errorf("restart callback saw log %v", nm.Log())
+			}
+			restarted = MakeServer()
+			restarted.AddService(MakeService(&JunkServer{}))
+			return restarted
+		}
+	}
+	nm.OnRestart(restart(nm))
+	nm.Start()
+
+	reply := ""
+	clock.Sleep(1500 * time.Millisecond)
+	if err := e.CallErr("JunkServer.Handler2", 1, &reply); errors.Is(err, ErrNoServer) == false {
+		t.Fatalf("expected ErrNoServer after kill, got %v", err)
+	}
+	clock.Sleep(time.Second)
+	if err := e.CallErr("JunkServer.Handler2", 1, &reply); errors.Is(err, ErrPartitioned) == false {
+		t.Fatalf("expected ErrPartitioned after partition, got %v", err)
+	}
+	if d := rn.ServerClock("server99").Now().Sub(clock.Now()); d != time.Hour {
+		t.Fatalf("wrong clock skew %v", d)
+	}
+	<-nm.Done()
+	if err := e.CallErr("JunkServer.Handler2", 1, &reply); err != nil {
+		t.Fatalf("call failed after heal: %v", err)
+	}
+	if rs.GetCount() != 0 || restarted.GetCount() != 1 {
+		t.Fatalf("call went to %v/%v the killed/restarted server", rs.GetCount(), restarted.GetCount())
+	}
+
+	log := nm.Log()
+	kinds := []FaultKind{FaultKill, FaultRestart, FaultSkew, FaultPartition, FaultHeal}
+	if len(log) != len(kinds) {
+		t.Fatalf("wrong log %v", log)
+	}
+	for i, ev := range log {
+		if ev.Fault.Kind != kinds[i] || ev.At < time.Second || ev.At > 3*time.Second {
+			t.Fatalf("wrong event %v", ev)
+		}
+	}
+
+	// 重放得到同样的故障序列
+	rn2 := MakeNetWork(WithClock(clock))
+	rn2.AddServer("server99", rs)
+	nm2 := MakeNemesis(rn2, Replay(log))
+	nm2.OnRestart(restart(nm2))
+	nm2.Start()
+	<-nm2.Done()
+	for i, ev := range nm2.Log() {
+		if ev.Fault.String() != log[i].Fault.String() || ev.At != log[i].At {
+			t.Fatalf("replayed %v, expected %v", ev, log[i])
+		}
+	}
+}
+
+// FaultHeal 只撤销 FaultSlow 的设置; 没有 OnRestart() 的 restart 被忽略
+func TestNemesisHeal(t *testing.T) {
+	rn := MakeNetWork()
+	rn.AddServer("server1", MakeServer())
+	rn.AddServer("server2", MakeServer())
+
+	wan := LinkProfile{Latency: time.Second}
+	link := LinkProfile{Latency: 2 * time.Second}
+	rn.SetServerProfile("server1", wan)
+	rn.SetLinkProfile("end1", "server2", link)
+
+	nm := MakeNemesis(rn, Script())
+	nm.Apply(Fault{Kind: FaultSlow, Server: "server1", Profile: defaultSlow})
+	nm.Apply(Fault{Kind: FaultSlow, Server: "server2", Profile: defaultSlow})
+	nm.Apply(Fault{Kind: FaultSlow, Server: "server2", Profile: defaultSlow})
+	nm.Apply(Fault{Kind: FaultHeal})
+
+	rn.mu.Lock()
+	p1 := rn.profileLocked("end2", "server1")
+	p2, slowed := rn.serverProfiles["server2"]
+	p3 := rn.profileLocked("end1", "server2")
+	rn.mu.Unlock()
+	if p1 != wan || slowed || p3 != link {
+		t.Fatalf("heal changed user profiles: %+v %+v(%v) %+v", p1, p2, slowed, p3)
+	}
+
+	nm.Apply(Fault{Kind: FaultKill, Server: "server1"})
+	if nm.Apply(Fault{Kind: FaultRestart, Server: "server1"}) {
+		t.Fatalf("restart without OnRestart() succeeded")
+	}
+	if n := len(nm.Log()); n != 5 {
+		t.Fatalf("wrong log %v", nm.Log())
+	}
+}
+
+// 相同种子的随机计划是相同的
+func TestNemesisRandom(t *testing.T) {
+	cfg := RandomConfig{
+		Nodes: []Node{
+			{Server: 0, Ends: []interface{}{"0-1", "0-2"}},
+			{Server: 1, Ends: []interface{}{"1-0", "1-2"}},
+			{Server: 2, Ends: []interface{}{"2-0", "2-1"}},
+		},
+		Weights:  map[FaultKind]int{FaultPartition: 3, FaultHeal: 2, FaultKill: 1, FaultRestart: 1, FaultSlow: 1, FaultSkew: 1},
+		Interval: time.Second,
+		Steps:    50,
+		MaxSkew:  time.Minute,
+	}
+	s1 := Random(rand.New(rand.NewSource(7)), cfg)
+	s2 := Random(rand.New(rand.NewSource(7)), cfg)
+
+	killed := map[interface{}]bool{}
+	var at time.Duration
+	n := 0
+	for {
+		a, ok1 := s1.Next()
+		b, ok2 := s2.Next()
+		if ok1 != ok2 || a.At != b.At || a.Fault.String() != b.Fault.String() {
+			t.Fatalf("different schedules %v %v", a, b)
+		}
+		if !ok1 {
+			break
+		}
+		n++
+		if a.At < at+cfg.Interval/2 {
+			t.Fatalf("step %v too early", a)
+		}
+		at = a.At
+		switch a.Fault.Kind {
+		case FaultKill:
+			if killed[a.Fault.Server] {
+				t.Fatalf("killed %v twice", a.Fault.Server)
+			}
+			killed[a.Fault.Server] = true
+		case FaultRestart:
+			if !killed[a.Fault.Server] {
+				t.Fatalf("restarted %v which is alive", a.Fault.Server)
+			}
+			delete(killed, a.Fault.Server)
+		case FaultSkew:
+			if a.Fault.Skew < -cfg.MaxSkew || a.Fault.Skew > cfg.MaxSkew {
+				t.Fatalf("skew %v out of range", a.Fault.Skew)
+			}
+		}
+	}
+	if n != cfg.Steps {
+		t.Fatalf("got %v steps, expected %v", n, cfg.Steps)
+	}
+}
+
+// DeleteServer 之后, 被删除的 server 的写入不会影响重启的 server
+func TestPersister(t *testing.T) {
+	rn := MakeNetWork()
+
+	ps := rn.Persister("server99")
+	if rn.Persister("server99") != ps {
+		t.Fatalf("Persister() returned a different persister")
+	}
+	ps.SaveRaftState([]byte("state1"))
+	ps.SaveStateAndSnapshot([]byte("state2"), []byte("snap2"))
+	if string(ps.ReadRaftState()) != "state2" || string(ps.ReadSnapshot()) != "snap2" {
+		t.Fatalf("wrong state %q %q", ps.ReadRaftState(), ps.ReadSnapshot())
+	}
+	if ps.RaftStateSize() != 6 || ps.SnapshotSize() != 5 {
+		t.Fatalf("wrong sizes %v %v", ps.RaftStateSize(), ps.SnapshotSize())
+	}
+
+	rn.AddServer("server99", MakeServer())
+	rn.DeleteServer("server99")
+
+	// 旧的 server 还在运行, 继续写入旧的 Persister
+	ps.SaveRaftState([]byte("zombie"))
+
+	ps2 := rn.Persister("server99")
+	if ps2 == ps {
+		t.Fatalf("DeleteServer() did not replace the persister")
+	}
+	if string(ps2.ReadRaftState()) != "state2" || string(ps2.ReadSnapshot()) != "snap2" {
+		t.Fatalf("restarted server sees %q %q", ps2.ReadRaftState(), ps2.ReadSnapshot())
+	}
+
+	// 读出的数据是副本
+	b := ps2.ReadRaftState()
+	b[0] = 'x'
+	if string(ps2.ReadRaftState()) != "state2" {
+		t.Fatalf("ReadRaftState() returned persister's buffer")
+	}
+}
+
+// FilePersister 崩溃时丢失没有 Sync 的写入, 破坏的状态文件可以被检测出来
+func TestFilePersister(t *testing.T) {
+	fp, err := MakeFilePersister(t.TempDir())
+	if err != nil {
+		t.Fatalf("MakeFilePersister() failed: %v", err)
+	}
+	fp.SaveStateAndSnapshot([]byte("state1"), []byte("snap1"))
+	reopened, err := MakeFilePersister(fp.Dir())
+	if err != nil || reopened.RecoverErr() != nil {
+		t.Fatalf("reopen failed: %v %v", err, reopened.RecoverErr())
+	}
+	if string(reopened.ReadRaftState()) != "state1" || string(reopened.ReadSnapshot()) != "snap1" {
+		t.Fatalf("reopened persister sees %q %q", reopened.ReadRaftState(), reopened.ReadSnapshot())
+	}
+
+	crash := func(faults CrashFaults, sync bool) *FilePersister {
+		rn := MakeNetWork()
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "other"), []byte("x"), 0644); err != nil {
+			t.Fatalf("WriteFile() failed: %v", err)
+		}
+		fp, _ := MakeFilePersister(dir)
+		fp.SetCrashFaults(faults)
+		rn.SetStorage("server99", fp)
+		rn.AddServer("server99", MakeServer())
+
+		fp.SaveRaftState([]byte("a"))
+		if sync {
+			fp.Sync()
+		}
+		fp.SaveRaftState([]byte("b"))
+		fp.SaveRaftState([]byte("c"))
+		rn.DeleteServer("server99")
+		fp.SaveRaftState([]byte("zombie"))
+
+		np := rn.Storage("server99").(*FilePersister)
+		if np.Dir() != dir {
+			t.Fatalf("restarted persister moved from %v to %v", dir, np.Dir())
+		}
+		// 旧的 FilePersister 不再拥有状态文件, 调用者的其它文件不受影响
+		fp.Remove()
+		reopened, err := MakeFilePersister(dir)
+		if err != nil || string(reopened.ReadRaftState()) != string(np.ReadRaftState()) {
+			t.Fatalf("reopened %v sees %q, expected %q", dir, reopened.ReadRaftState(), np.ReadRaftState())
+		}
+		if _, err := os.Stat(filepath.Join(dir, "other")); err != nil {
+			t.Fatalf("caller's file was removed: %v", err)
+		}
+		return np
+	}
+
+	if np := crash(CrashFaults{}, false); string(np.ReadRaftState()) != "c" {
+		t.Fatalf("expected c without faults, got %q", np.ReadRaftState())
+	}
+	if np := crash(CrashFaults{LoseUnsynced: 1}, false); string(np.ReadRaftState()) != "b" {
+		t.Fatalf("expected b after losing one write, got %q", np.ReadRaftState())
+	}
+	if np := crash(CrashFaults{LoseUnsynced: -1}, true); string(np.ReadRaftState()) != "a" {
+		t.Fatalf("expected synced a after losing all unsynced writes, got %q", np.ReadRaftState())
+	}
+	if np := crash(CrashFaults{LoseUnsynced: -1}, false); np.RaftStateSize() != 0 {
+		t.Fatalf("expected empty state, got %q", np.ReadRaftState())
+	}
+	if np := crash(CrashFaults{CorruptRate: 1}, false); errors.Is(np.RecoverErr(), ErrCorrupt) == false || np.RaftStateSize() != 0 {
+		t.Fatalf("expected ErrCorrupt, got %v %q", np.RecoverErr(), np.ReadRaftState())
+	}
+
+	// torn write 要么被检测出来, 要么留下之前的内容
+	corrupt := 0
+	for seed := int64(0); seed < 20; seed++ {
+		np := crash(CrashFaults{TornRate: 1, Seed: seed}, false)
+		if err := np.RecoverErr(); err != nil {
+			corrupt++
+		} else if string(np.ReadRaftState()) != "b" {
+			t.Fatalf("torn write recovered as %q", np.ReadRaftState())
+		}
+	}
+	if corrupt == 0 {
+		t.Fatalf("no torn write was detected")
+	}
+
+	// 临时目录由 FilePersister 创建时, 崩溃之后由重启的 FilePersister 删除
+	tmp, _ := MakeFilePersister("")
+	tmp.SaveRaftState([]byte("a"))
+	np := tmp.Crash().(*FilePersister)
+	if np.Dir() != tmp.Dir() || string(np.ReadRaftState()) != "a" {
+		t.Fatalf("crash of temp persister: %v %q", np.Dir(), np.ReadRaftState())
+	}
+	np.Remove()
+	if _, err := os.Stat(tmp.Dir()); os.IsNotExist(err) == false {
+		t.Fatalf("temp dir %v was not removed: %v", tmp.Dir(), err)
+	}
+
+	// 误用时 panic, 测试可以 recover
+	expectPanic := func(target error, f func()) {
+		defer func() {
+			err, _ := recover().(error)
+			if errors.Is(err, target) == false {
+				t.Fatalf("expected panic with %v, got %v", target, err)
+			}
+		}()
+		f()
+	}
+	rn := MakeNetWork()
+	removed, _ := MakeFilePersister(t.TempDir())
+	removed.Remove()
+	rn.SetStorage("server99", removed)
+	expectPanic(ErrCrashed, func() { rn.DeleteServer("server99") })
+	expectPanic(ErrCrashed, func() { tmp.Crash() })
+	expectPanic(ErrStorageType, func() { rn.Persister("server99") })
+}
+
+// Unreachable 可以针对单条链路设置不可达时的延迟
+func TestUnreachableProfile(t *testing.T) {
+	clock := NewSimClock(time.Unix(0, 0))
+	defer clock.Stop()
+
+	rn := MakeNetWork(WithClock(clock))
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+	rn.Partition([]interface{}{"end1-99"}, []interface{}{"server99"})
+
+	reply := ""
+	rn.SetEndProfile("end1-99", LinkProfile{})
+	s0 := clock.Now()
+	e.Call("JunkServer.Handler2", 1, &reply)
+	if d := clock.Now().Sub(s0); d != 0 {
+		t.Fatalf("unreachable call took %v with zero profile", d)
+	}
+
+	rn.SetEndProfile("end1-99", LinkProfile{Unreachable: time.Hour})
+	s0 = clock.Now()
+	for i := 0; i < 5; i++ {
+		e.Call("JunkServer.Handler2", 1, &reply)
+	}
+	if d := clock.Now().Sub(s0); d < 10*time.Second || d > 5*time.Hour {
+		t.Fatalf("unreachable calls took %v, expected up to an hour each", d)
+	}
+}
+
+// handler 开始执行之后客户端被禁用, 错误与统计都记录 handler 已经执行
+func TestReplyLostAfterExecution(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetWork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	done := make(chan error)
+	go func() {
+		reply := 0
+		done <- e.CallErr("JunkServer.Handler3", 99, &reply)
+	}()
+	for rs.GetCount() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rn.Enable("end1-99", false)
+
+	err := <-done
+	if errors.Is(err, ErrReplyLost) == false || errors.Is(err, ErrDisabled) == false {
+		t.Fatalf("expected executed ErrDisabled, got %v", err)
+	}
+
+	reply := ""
+	if err := e.CallErr("JunkServer.Handler2", 1, &reply); errors.Is(err, ErrDisabled) == false || errors.Is(err, ErrReplyLost) {
+		t.Fatalf("expected plain ErrDisabled before dispatch, got %v", err)
+	}
+
+	ms := rn.Stats().Methods["JunkServer.Handler3"]
+	if ms.RepliesLost != 1 || ms.Drops != 1 {
+		t.Fatalf("wrong method stats %+v", ms)
+	}
+
+	if err := executed(nil); errors.Is(err, ErrReplyLost) == false || err.Error() == "" {
+		t.Fatalf("executed(nil) should still be a reply loss, got %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package labrpc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// 流量统计, 字节数来自 gob 编码后的参数与回复
+type Traffic struct {
+	Count      int64 // 发出的请求数
+	ReqBytes   int64 // 请求参数的字节数
+	ReplyBytes int64 // 送达客户端的回复的字节数
+}
+
+// 请求与回复的总字节数
+func (t Traffic) Bytes() int64 {
+	return t.ReqBytes + t.ReplyBytes
+}
+
+// Histogram 的桶的上界, 最后一个桶没有上界
+var HistogramBounds = []time.Duration{
+	1 * time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	1 * time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second,
+}
+
+// 耗时的直方图, 时间由 Network 的 Clock 给出
+type Histogram struct {
+	Count   int64
+	Sum     time.Duration
+	Max     time.Duration
+	Buckets []int64 // Buckets[i] 为不超过 HistogramBounds[i] 的数量, 最后一个为超过所有上界的数量
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	if h.Buckets == nil {
+		h.Buckets = make([]int64, len(HistogramBounds)+1)
+	}
+	i := 0
+	for i < len(HistogramBounds) && d > HistogramBounds[i] {
+		i++
+	}
+	h.Buckets[i]++
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+func (h Histogram) copy() Histogram {
+	h.Buckets = append([]int64(nil), h.Buckets...)
+	return h
+}
+
+// 平均耗时
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// 分位数的近似值, 返回第 q 分位所在的桶的上界 (最后一个桶返回 Max)
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(h.Count))
+	var n int64
+	for i, c := range h.Buckets {
+		n += c
+		if n > rank && i < len(HistogramBounds) {
+			return HistogramBounds[i]
+		}
+	}
+	return h.Max
+}
+
+// 某个方法的统计, Count 即发出的请求数
+type MethodStats struct {
+	Traffic
+	Successes  int64 // 回复送达客户端 (包括 handler 返回 error)
+	Drops      int64 // 被网络丢弃、客户端被禁用、被分区或没有连接 server
+	ServerDead int64 // server 在处理过程中被删除
+	Failures   int64 // 找不到 service/method 或 handler panic
+	Abandoned  int64 // 客户端在收到回复之前放弃了等待
+	InFlight   int64 // 正在处理中的请求
+	Duplicates int64 // 被网络重复投递给 server 的请求
+
+	RequestsLost int64 // Drops 中请求在到达 server 之前丢失的次数
+	RepliesLost  int64 // handler 已经执行但回复没有送达的次数 (丢包、分区、server 被删除等)
+
+	NetworkDelay Histogram // 除去 handler 执行的时间, 只统计执行了 handler 的请求
+	HandlerTime  Histogram // handler 执行的时间
+	Total        Histogram // Network 收到请求到回复客户端的时间
+}
+
+// Network.Stats() 返回的快照
+type Stats struct {
+	Total    Traffic
+	InFlight int64                   // 正在处理中的请求
+	Methods  map[string]MethodStats  // by svcMeth
+	Servers  map[interface{}]Traffic // by server name
+	Ends     map[interface{}]Traffic // by end name
+}
+
+// Network 的统计数据, 有自己的锁, 不与 Network.mu 竞争
+type netStats struct {
+	mu       sync.Mutex
+	total    Traffic
+	inFlight int64
+	byServer map[interface{}]*Traffic // by server name
+	byEnd    map[interface{}]*Traffic // by end name
+	byMethod map[string]*MethodStats  // by svcMeth
+}
+
+func makeNetStats() *netStats {
+	return &netStats{
+		byServer: map[interface{}]*Traffic{},
+		byEnd:    map[interface{}]*Traffic{},
+		byMethod: map[string]*MethodStats{},
+	}
+}
+
+func (st *netStats) methodLocked(svcMeth string) *MethodStats {
+	ms, ok := st.byMethod[svcMeth]
+	if !ok {
+		ms = &MethodStats{}
+		st.byMethod[svcMeth] = ms
+	}
+	return ms
+}
+
+// 返回 (end, server, method) 对应的流量统计项, 调用者需持有 st.mu
+func (st *netStats) trafficLocked(req reqMsg) []*Traffic {
+	get := func(m map[interface{}]*Traffic, key interface{}) *Traffic {
+		t, ok := m[key]
+		if !ok {
+			t = &Traffic{}
+			m[key] = t
+		}
+		return t
+	}
+	ts := []*Traffic{&st.total, get(st.byEnd, req.endname), &st.methodLocked(req.svcMeth).Traffic}
+	if req.servername != nil {
+		ts = append(ts, get(st.byServer, req.servername))
+	}
+	return ts
+}
+
+// 记录一个发出的请求
+func (st *netStats) request(req reqMsg) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, t := range st.trafficLocked(req) {
+		t.Count++
+		t.ReqBytes += int64(len(req.args))
+	}
+	st.inFlight++
+	st.methodLocked(req.svcMeth).InFlight++
+}
+
+// 记录一个被重复投递的请求
+func (st *netStats) duplicate(req reqMsg) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.methodLocked(req.svcMeth).Duplicates++
+}
+
+// 记录一个请求的结果, delivered 表示 msg 送达了客户端
+func (st *netStats) finish(req reqMsg, msg replyMsg, delivered bool, total time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	ms := st.methodLocked(req.svcMeth)
+	st.inFlight--
+	ms.InFlight--
+	switch {
+	case !delivered:
+		ms.Abandoned++
+	case msg.ok:
+		ms.Successes++
+		for _, t := range st.trafficLocked(req) {
+			t.ReplyBytes += int64(len(msg.reply))
+		}
+	case errors.Is(msg.err, ErrServerDead):
+		ms.ServerDead++
+	case errors.Is(msg.err, ErrDropped) || errors.Is(msg.err, ErrDisabled) ||
+		errors.Is(msg.err, ErrPartitioned) || errors.Is(msg.err, ErrNoServer):
+		ms.Drops++
+	default:
+		ms.Failures++
+	}
+
+	if delivered && errors.Is(msg.err, ErrRequestLost) {
+		ms.RequestsLost++
+	} else if delivered && errors.Is(msg.err, ErrReplyLost) {
+		ms.RepliesLost++
+	}
+
+	ms.Total.observe(total)
+	if msg.ok {
+		ms.HandlerTime.observe(msg.handlerTime)
+		ms.NetworkDelay.observe(total - msg.handlerTime)
+	}
+}
+
+// 返回统计数据的快照
+func (rn *Network) Stats() Stats {
+	rn.stats.mu.Lock()
+	defer rn.stats.mu.Unlock()
+
+	s := Stats{
+		Total:    rn.stats.total,
+		InFlight: rn.stats.inFlight,
+		Methods:  map[string]MethodStats{},
+		Servers:  map[interface{}]Traffic{},
+		Ends:     map[interface{}]Traffic{},
+	}
+	for k, t := range rn.stats.byServer {
+		s.Servers[k] = *t
+	}
+	for k, t := range rn.stats.byEnd {
+		s.Ends[k] = *t
+	}
+	for k, ms := range rn.stats.byMethod {
+		c := *ms
+		c.NetworkDelay = ms.NetworkDelay.copy()
+		c.HandlerTime = ms.HandlerTime.copy()
+		c.Total = ms.Total.copy()
+		s.Methods[k] = c
+	}
+	return s
+}
+
+// 网络中发出的 RPC 总数
+func (rn *Network) GetTotalCount() int {
+	rn.stats.mu.Lock()
+	defer rn.stats.mu.Unlock()
+
+	return int(rn.stats.total.Count)
+}
+
+// 网络中传输的请求与回复的总字节数
+func (rn *Network) GetTotalBytes() int64 {
+	rn.stats.mu.Lock()
+	defer rn.stats.mu.Unlock()
+
+	return rn.stats.total.Bytes()
+}
+
+// 发往某个 server 的流量
+func (rn *Network) GetServerTraffic(servername interface{}) Traffic {
+	rn.stats.mu.Lock()
+	defer rn.stats.mu.Unlock()
+
+	if t, ok := rn.stats.byServer[servername]; ok {
+		return *t
+	}
+	return Traffic{}
+}
+
+// 某个客户端发出的流量
+func (rn *Network) GetEndTraffic(endname interface{}) Traffic {
+	rn.stats.mu.Lock()
+	defer rn.stats.mu.Unlock()
+
+	if t, ok := rn.stats.byEnd[endname]; ok {
+		return *t
+	}
+	return Traffic{}
+}
+
+// 某个方法的流量, svcMeth e.g. "Raft.AppendEntries"
+func (rn *Network) GetMethodTraffic(svcMeth string) Traffic {
+	rn.stats.mu.Lock()
+	defer rn.stats.mu.Unlock()
+
+	if ms, ok := rn.stats.byMethod[svcMeth]; ok {
+		return ms.Traffic
+	}
+	return Traffic{}
+}